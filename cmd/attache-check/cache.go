@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// checkResult is a response to a check request that can be cached and written
+// to any number of requests.
+type checkResult struct {
+	code        int
+	contentType string
+	body        []byte
+}
+
+// textResult returns a plain text checkResult with a status of `code` and a
+// body formatted like fmt.Sprintf.
+func textResult(code int, format string, a ...interface{}) checkResult {
+	return checkResult{code, "text/plain; charset=utf-8", []byte(fmt.Sprintf(format, a...))}
+}
+
+// jsonResult returns a checkResult with a status of `code` and `v`, encoded as
+// JSON, as the body.
+func jsonResult(code int, v interface{}) checkResult {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return textResult(http.StatusInternalServerError, "Unable to encode response: %s", err)
+	}
+	return checkResult{code, "application/json", append(body, '\n')}
+}
+
+// write writes `c` as the response to `w`.
+func (c checkResult) write(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", c.contentType)
+	w.WriteHeader(c.code)
+	_, _ = w.Write(c.body)
+}
+
+// cacheEntry is a checkResult that's either in-flight, in which case done is
+// open, or expires at expires.
+type cacheEntry struct {
+	done    chan struct{}
+	expires time.Time
+	result  checkResult
+}
+
+// resultCache caches checkResults for a short time so that many concurrent
+// check requests, from Consul agents and operators, share a single round of
+// queries to the Redis node. Requests that arrive while a result is in-flight
+// wait for it rather than querying the Redis node themselves.
+type resultCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+// newResultCache returns a resultCache that keeps results for `ttl`. Results
+// aren't cached if `ttl` is 0, but concurrent requests still share in-flight
+// results.
+func newResultCache(ttl time.Duration) *resultCache {
+	return &resultCache{ttl: ttl, now: time.Now, entries: make(map[string]*cacheEntry)}
+}
+
+// get returns the cached result for `key` if it hasn't expired. Otherwise it
+// waits for the in-flight result for `key` or, if there isn't one, returns the
+// result of calling `check` and caches it.
+func (c *resultCache) get(key string, check func() checkResult) checkResult {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if ok {
+		select {
+		case <-entry.done:
+			if c.now().Before(entry.expires) {
+				c.mu.Unlock()
+				return entry.result
+			}
+		default:
+			c.mu.Unlock()
+			<-entry.done
+			return entry.result
+		}
+	}
+	c.removeExpired()
+	entry = &cacheEntry{done: make(chan struct{})}
+	c.entries[key] = entry
+	c.mu.Unlock()
+
+	entry.result = check()
+
+	c.mu.Lock()
+	entry.expires = c.now().Add(c.ttl)
+	if c.ttl <= 0 {
+		delete(c.entries, key)
+	}
+	c.mu.Unlock()
+	close(entry.done)
+	return entry.result
+}
+
+// removeExpired removes every expired result. It must be called with mu held.
+func (c *resultCache) removeExpired() {
+	now := c.now()
+	for key, entry := range c.entries {
+		select {
+		case <-entry.done:
+			if !now.Before(entry.expires) {
+				delete(c.entries, key)
+			}
+		default:
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_resultCache(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := newResultCache(time.Second)
+	c.now = func() time.Time { return now }
+
+	var calls int
+	check := func() checkResult {
+		calls++
+		return textResult(http.StatusOK, "call %d", calls)
+	}
+
+	for _, step := range []struct {
+		advance   time.Duration
+		key       string
+		wantBody  string
+		wantCalls int
+	}{
+		{0, "/a", "call 1", 1},
+		{500 * time.Millisecond, "/a", "call 1", 1},
+		{0, "/b", "call 2", 2},
+		{500 * time.Millisecond, "/a", "call 3", 3},
+		{0, "/b", "call 2", 3},
+	} {
+		now = now.Add(step.advance)
+		got := c.get(step.key, check)
+		if string(got.body) != step.wantBody || calls != step.wantCalls {
+			t.Errorf("get(%q) at %s = %q after %d calls, want %q after %d calls", step.key, now, got.body, calls, step.wantBody, step.wantCalls)
+		}
+	}
+}
+
+func Test_resultCacheSharesInFlight(t *testing.T) {
+	// Results are cached for long enough that requests arriving after the
+	// in-flight result is released still share it.
+	c := newResultCache(time.Minute)
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	var mu sync.Mutex
+	var calls int
+	check := func() checkResult {
+		mu.Lock()
+		calls++
+		if calls == 1 {
+			close(started)
+		}
+		mu.Unlock()
+		<-release
+		return textResult(http.StatusOK, "ok")
+	}
+
+	var wg sync.WaitGroup
+	results := make([]checkResult, 5)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[0] = c.get("/a", check)
+	}()
+	<-started
+	for i := 1; i < len(results); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = c.get("/a", check)
+		}(i)
+	}
+	// Give the waiting requests a chance to find the in-flight result.
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("check called %d times, want 1", calls)
+	}
+	for i, r := range results {
+		if string(r.body) != "ok" {
+			t.Errorf("result %d = %q, want %q", i, r.body, "ok")
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// dampingOpts are the thresholds used to damp flapping health checks.
+type dampingOpts struct {
+	// failures is the number of consecutive failed checks, with a status of
+	// warning or critical, before a passing node is reported as failing.
+	failures int
+
+	// successes is the number of consecutive passing checks before a failing
+	// node is reported as passing.
+	successes int
+}
+
+// damper damps transitions between the passing and failing statuses of a
+// series of checks, so that a status that flaps, for instance while the
+// cluster converges via gossip, doesn't move the node in and out of the Consul
+// Service Catalog with every check.
+type damper struct {
+	opts dampingOpts
+
+	mu sync.Mutex
+
+	// reported is the status last reported, or empty if nothing has been
+	// reported.
+	reported status
+
+	// streak is the status of the latest check, and count is the number of
+	// consecutive checks that were passing, or failing, up to and including
+	// it.
+	streak status
+	count  int
+}
+
+// observe records the status of a check, `checked`, and returns the status to
+// report and a description of the current streak. The status reported only
+// changes from passing to failing, or from failing to passing, once the streak
+// of checks with the new status reaches the corresponding threshold. The first
+// status observed is always reported.
+func (d *damper) observe(checked status) (status, string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	failing := checked != statusPassing
+	if d.count > 0 && failing != (d.streak != statusPassing) {
+		d.count = 0
+	}
+	d.count++
+	d.streak = checked
+
+	switch {
+	case d.reported == "":
+		d.reported = checked
+	case failing && (d.reported != statusPassing || d.count >= d.opts.failures):
+		d.reported = checked
+	case !failing && (d.reported == statusPassing || d.count >= d.opts.successes):
+		d.reported = statusPassing
+	}
+	return d.reported, d.describe()
+}
+
+// describe returns a description of the current streak and, if the status
+// reported differs from that of the streak, the length the streak must reach
+// before the status reported changes. It must be called with mu held.
+func (d *damper) describe() string {
+	description := fmt.Sprintf("streak: %d consecutive %s", d.count, d.streak)
+	if d.reported == d.streak {
+		return description
+	}
+	threshold := d.opts.successes
+	if d.streak != statusPassing {
+		threshold = d.opts.failures
+	}
+	return fmt.Sprintf("%s, reporting %s until %d", description, d.reported, threshold)
+}
+
+// damper returns the damper for the series of checks that evaluate `rules`,
+// creating it if this is the first such check.
+func (h *CheckHandler) damper(rules []rule) *damper {
+	key := ruleNames(rules)
+
+	h.dampersMu.Lock()
+	defer h.dampersMu.Unlock()
+	d, ok := h.dampers[key]
+	if !ok {
+		d = &damper{opts: h.dampingOpts}
+		if h.dampers == nil {
+			h.dampers = make(map[string]*damper)
+		}
+		h.dampers[key] = d
+	}
+	return d
+}
@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+func Test_damper(t *testing.T) {
+	type step struct {
+		checked      status
+		wantReported status
+		wantStreak   string
+	}
+	tests := []struct {
+		name  string
+		opts  dampingOpts
+		steps []step
+	}{
+		{
+			"no damping",
+			dampingOpts{failures: 1, successes: 1},
+			[]step{
+				{statusPassing, statusPassing, "streak: 1 consecutive passing"},
+				{statusCritical, statusCritical, "streak: 1 consecutive critical"},
+				{statusPassing, statusPassing, "streak: 1 consecutive passing"},
+				{statusPassing, statusPassing, "streak: 2 consecutive passing"},
+			},
+		},
+		{
+			"flapping while passing",
+			dampingOpts{failures: 3, successes: 2},
+			[]step{
+				{statusPassing, statusPassing, "streak: 1 consecutive passing"},
+				{statusCritical, statusPassing, "streak: 1 consecutive critical, reporting passing until 3"},
+				{statusCritical, statusPassing, "streak: 2 consecutive critical, reporting passing until 3"},
+				{statusPassing, statusPassing, "streak: 1 consecutive passing"},
+				{statusCritical, statusPassing, "streak: 1 consecutive critical, reporting passing until 3"},
+				{statusWarning, statusPassing, "streak: 2 consecutive warning, reporting passing until 3"},
+				{statusCritical, statusCritical, "streak: 3 consecutive critical"},
+			},
+		},
+		{
+			"recovering",
+			dampingOpts{failures: 3, successes: 2},
+			[]step{
+				{statusCritical, statusCritical, "streak: 1 consecutive critical"},
+				{statusPassing, statusCritical, "streak: 1 consecutive passing, reporting critical until 2"},
+				{statusWarning, statusWarning, "streak: 1 consecutive warning"},
+				{statusPassing, statusWarning, "streak: 1 consecutive passing, reporting warning until 2"},
+				{statusPassing, statusPassing, "streak: 2 consecutive passing"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := damper{opts: tt.opts}
+			for i, s := range tt.steps {
+				reported, streak := d.observe(s.checked)
+				if reported != s.wantReported || streak != s.wantStreak {
+					t.Errorf("step %d: observe(%s) = %s, %q, want %s, %q", i, s.checked, reported, streak, s.wantReported, s.wantStreak)
+				}
+			}
+		})
+	}
+}
@@ -5,13 +5,17 @@ import (
 	"flag"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
 	redis "github.com/letsencrypt/attache/src/redis/client"
 	"github.com/letsencrypt/attache/src/redis/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	logger "github.com/sirupsen/logrus"
 )
 
@@ -20,29 +24,171 @@ import (
 // router.
 type CheckHandler struct {
 	redis.Client
+
+	// redisOpts are used to connect to the primary of this node.
+	redisOpts config.RedisOpts
+
+	// rules are every health rule, including optional ones.
+	rules []rule
+
+	// probeOpts configure the synthetic read/write probe.
+	probeOpts probeOpts
+
+	// timeout is the deadline for the queries made by each check.
+	timeout time.Duration
+
+	// cache shares check results between concurrent requests.
+	cache *resultCache
+
+	// dampers damp the status reported by StateOk for each distinct set of
+	// rules evaluated.
+	dampingOpts dampingOpts
+	dampersMu   sync.Mutex
+	dampers     map[string]*damper
+
+	// primary is a client for the primary at primaryAddr, which was the
+	// primary of this node as of the latest check that needed it.
+	primaryMu   sync.Mutex
+	primaryAddr string
+	primary     *sharedClient
+
+	// maxClientsValue is the maxclients of this node, as read with 'CONFIG
+	// GET' at maxClientsAt, for Redis versions that don't report it in 'INFO
+	// clients'.
+	maxClientsMu    sync.Mutex
+	maxClientsValue int64
+	maxClientsAt    time.Time
+
+	// rejected is the total number of connections rejected by this node as of
+	// the previous check in each series of checks.
+	rejectedMu sync.Mutex
+	rejected   map[string]int64
+}
+
+// respond writes the result of `check`, which is called with a context that
+// expires after the check timeout and the query parameters of `r`, to `w`.
+// Results are shared by concurrent requests with the same path and query
+// parameters and cached for a short time.
+func (h *CheckHandler) respond(w http.ResponseWriter, r *http.Request, check func(ctx context.Context, query url.Values) checkResult) {
+	query := r.URL.Query()
+	result := h.cache.get(r.URL.Path+"?"+query.Encode(), func() checkResult {
+		// The result may be shared with other requests, so it mustn't be
+		// cancelled with this one.
+		ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+		defer cancel()
+		return check(ctx, query)
+	})
+	result.write(w)
 }
 
 // StateOK handles health checks from Consul. A 200 response from this handler
-// means that, from this Redis Cluster node's perspective, the Redis Cluster
-// State is OK and Consul can begin advertising this node as part of the Redis
-// Cluster in the Service Catalog.
+// means that, from this Redis Cluster node's perspective, every health rule
+// passed, including that the Redis Cluster State is OK, and Consul can begin
+// advertising this node as part of the Redis Cluster in the Service Catalog. A
+// 429 response, which Consul treats as a warning, means that no rule failed
+// with a status worse than warning, and a 503 response means that at least one
+// rule failed with a status of critical. Optional rules are only evaluated when
+// named by the 'rule' query parameter. The body is the Redis Cluster State
+// followed by a line for each rule that failed and a line describing the
+// current streak of passing or failing checks. Transitions between passing and
+// failing are damped: they're only reported once the streak reaches the
+// configured number of consecutive checks.
 func (h *CheckHandler) StateOk(w http.ResponseWriter, r *http.Request) {
-	clusterInfo, err := h.GetClusterInfo()
+	h.respond(w, r, h.stateOk)
+}
+
+func (h *CheckHandler) stateOk(ctx context.Context, query url.Values) checkResult {
+	rules, err := selectRules(h.rules, query)
+	if err != nil {
+		return textResult(http.StatusBadRequest, "%s", err)
+	}
+	result, checked := h.evaluate(ctx, rules)
+
+	// Failing to query the node counts as a critical failure, but the result
+	// still describes the error rather than the rules.
+	reported, streak := h.damper(rules).observe(checked)
+	if reported != checked {
+		result.code = reported.code()
+	}
+	result.body = append(result.body, "\n"+streak...)
+	return result
+}
+
+// evaluate gathers the state needed by `rules` and evaluates them. It returns
+// the undamped result and its status. The body of the result is the Redis
+// Cluster State followed by a line for each rule that failed, or a description
+// of the error if the node couldn't be queried.
+func (h *CheckHandler) evaluate(ctx context.Context, rules []rule) (checkResult, status) {
+	clusterInfo, err := h.GetClusterInfo(ctx)
+	if err != nil {
+		checkErrors.WithLabelValues("state-ok").Inc()
+		return textResult(http.StatusInternalServerError, "Unable to connect to node %q: %s", h.NodeAddr, err), statusCritical
+	}
+
+	s := nodeState{info: clusterInfo, series: seriesKey("state-ok", rules)}
+	err = h.gatherState(ctx, rules, &s)
+	if err != nil {
+		checkErrors.WithLabelValues("state-ok").Inc()
+		return textResult(http.StatusInternalServerError, "Unable to check node %q: %s", h.NodeAddr, err), statusCritical
+	}
+
+	results, overall := evaluateRules(rules, s)
+	body := clusterInfo.State
+	for _, result := range results {
+		if !result.Passed {
+			body += fmt.Sprintf("\n%s (%s): %s", result.Name, result.Status, result.Message)
+		}
+	}
+	return textResult(overall.code(), "%s", body), overall
+}
+
+// StateNew handles health checks from Consul for the Await Consul Service. A
+// 200 response from this handler means that this Redis node is reachable,
+// accepted our credentials, and has never joined a cluster, so it's waiting to
+// be introduced to one. Once the node joins a cluster this handler responds 503
+// and Consul stops advertising it in the Await Consul Service.
+func (h *CheckHandler) StateNew(w http.ResponseWriter, r *http.Request) {
+	h.respond(w, r, h.stateNew)
+}
+
+func (h *CheckHandler) stateNew(ctx context.Context, query url.Values) checkResult {
+	clusterInfo, err := h.GetClusterInfo(ctx)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = w.Write([]byte(fmt.Sprintf("Unable to connect to node %q: %s", h.NodeAddr, err)))
-	} else if clusterInfo.State == "ok" {
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte(clusterInfo.State))
-	} else {
-		w.WriteHeader(http.StatusServiceUnavailable)
-		_, _ = w.Write([]byte(clusterInfo.State))
+		checkErrors.WithLabelValues("state-new").Inc()
+		return textResult(http.StatusInternalServerError, "Unable to connect to node %q: %s", h.NodeAddr, err)
 	}
+
+	if clusterInfo.IsNew() {
+		return textResult(http.StatusOK, "new")
+	}
+	return textResult(http.StatusServiceUnavailable, "joined, cluster_state is %q with %d known nodes", clusterInfo.State, clusterInfo.KnownNodes)
 }
 
 func main() {
 	checkServAddr := flag.String("check-serv-addr", "", "address this utility should listen on (e.g. 127.0.0.1:8080)")
 	shutdownGrace := flag.Duration("shutdown-grace", time.Second*5, "duration to wait before shutting down (e.g. '1s')")
+	checkTimeout := flag.Duration("check-timeout", time.Second, "deadline for the queries made by each check, which should be shorter than the timeout of the Consul check (e.g. '1s')")
+	checkCacheTTL := flag.Duration("check-cache-ttl", time.Second, "duration that check results are cached and shared between requests, 0 to only share in-flight results (e.g. '1s')")
+
+	var ruleOpts ruleOpts
+	flag.Int64Var(&ruleOpts.replicaMaxLag, "replica-max-lag-bytes", 1024*1024, "number of bytes the replication offset of a replica may lag behind its primary before the 'replica-synced' rule fails")
+	flag.Float64Var(&ruleOpts.memoryWarningRatio, "memory-warning-ratio", 0.8, "ratio of used_memory to maxmemory at which the 'memory-usage' rule warns, 0 to disable")
+	flag.Float64Var(&ruleOpts.memoryCriticalRatio, "memory-critical-ratio", 0.95, "ratio of used_memory to maxmemory at which the 'memory-usage' rule fails, 0 to disable")
+	flag.Float64Var(&ruleOpts.clientsWarningRatio, "clients-warning-ratio", 0.8, "ratio of connected_clients to maxclients at which the 'connected-clients' rule warns, 0 to disable")
+	flag.Float64Var(&ruleOpts.clientsCriticalRatio, "clients-critical-ratio", 0.95, "ratio of connected_clients to maxclients at which the 'connected-clients' rule fails, 0 to disable")
+	flag.Int64Var(&ruleOpts.blockedClientsWarning, "blocked-clients-warning", 0, "number of blocked_clients at which the 'blocked-clients' rule warns, 0 to disable")
+	flag.Int64Var(&ruleOpts.blockedClientsCritical, "blocked-clients-critical", 0, "number of blocked_clients at which the 'blocked-clients' rule fails, 0 to disable")
+	flag.Int64Var(&ruleOpts.rejectedConnectionsWarning, "rejected-connections-warning", 0, "number of connections rejected since the previous check at which the 'rejected-connections' rule warns, 0 to disable")
+	flag.Int64Var(&ruleOpts.rejectedConnectionsCritical, "rejected-connections-critical", 0, "number of connections rejected since the previous check at which the 'rejected-connections' rule fails, 0 to disable")
+	flag.BoolVar(&ruleOpts.persistenceErrorsCritical, "persistence-errors-critical", false, "fail the 'persistence-ok' rule with a status of critical, rather than warning, when the last RDB save or AOF write failed")
+
+	var dampingOpts dampingOpts
+	flag.IntVar(&dampingOpts.failures, "failures-before-critical", 1, "number of consecutive failed checks before a passing node is reported as failing")
+	flag.IntVar(&dampingOpts.successes, "successes-before-passing", 1, "number of consecutive passing checks before a failing node is reported as passing")
+
+	var probeOpts probeOpts
+	flag.StringVar(&probeOpts.keyPrefix, "probe-key-prefix", "", "prefix of keys written by the synthetic read/write probe at '/probe', which is disabled if empty")
+	flag.DurationVar(&probeOpts.maxLatency, "probe-max-latency", 100*time.Millisecond, "round-trip latency above which the synthetic read/write probe fails (e.g. '100ms')")
 
 	var redisOpts config.RedisOpts
 	flag.StringVar(&redisOpts.NodeAddr, "redis-node-addr", "", "redis-server listening address, (required)")
@@ -80,6 +226,27 @@ func main() {
 	if redisOpts.KeyFile == "" {
 		logger.Fatal("missing required opt: 'redis-tls-key-file'")
 	}
+
+	if *checkTimeout <= 0 {
+		logger.Fatal("opt 'check-timeout' must be greater than 0")
+	}
+
+	if *checkCacheTTL < 0 {
+		logger.Fatal("opt 'check-cache-ttl' must not be negative")
+	}
+
+	if dampingOpts.failures < 1 {
+		logger.Fatal("opt 'failures-before-critical' must be at least 1")
+	}
+
+	if dampingOpts.successes < 1 {
+		logger.Fatal("opt 'successes-before-passing' must be at least 1")
+	}
+
+	err := ruleOpts.validate()
+	if err != nil {
+		logger.Fatalf("invalid rule thresholds: %s", err)
+	}
 	logger.Infof("starting %s", os.Args[0])
 
 	router := mux.NewRouter()
@@ -87,8 +254,25 @@ func main() {
 	if err != nil {
 		logger.Fatalf("redis: %s", err)
 	}
-	handler := CheckHandler{*redisClient}
-	router.HandleFunc("/clusterinfo/state/ok", handler.StateOk)
+	handler := &CheckHandler{
+		Client:      *redisClient,
+		redisOpts:   redisOpts,
+		rules:       newRules(ruleOpts),
+		probeOpts:   probeOpts,
+		timeout:     *checkTimeout,
+		cache:       newResultCache(*checkCacheTTL),
+		dampingOpts: dampingOpts,
+	}
+	router.Handle("/clusterinfo/state/ok", instrument("state-ok", handler.StateOk))
+	router.Handle("/clusterinfo/state/new", instrument("state-new", handler.StateNew))
+	router.Handle("/clusterinfo", instrument("report", handler.Report))
+	if probeOpts.keyPrefix != "" {
+		router.Handle("/probe", instrument("probe", handler.Probe))
+		logger.Infof("serving synthetic read/write probes of keys prefixed %q", probeOpts.keyPrefix)
+	}
+
+	prometheus.MustRegister(newNodeCollector(redisClient, *checkTimeout))
+	router.Handle("/metrics", promhttp.Handler())
 
 	server := &http.Server{
 		Addr:         *checkServAddr,
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	redis "github.com/letsencrypt/attache/src/redis/client"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	logger "github.com/sirupsen/logrus"
+)
+
+var (
+	checkSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "attache_check_request_duration_seconds",
+		Help:    "Duration of check requests, by handler and response code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"handler", "code"})
+	checkErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "attache_check_errors_total",
+		Help: "Count of check requests that failed to query the Redis node, by handler.",
+	}, []string{"handler"})
+	probeSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "attache_check_probe_duration_seconds",
+		Help:    "Round-trip latency of synthetic read/write probes.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 12),
+	})
+	probeFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "attache_check_probe_failures_total",
+		Help: "Count of synthetic read/write probes that failed or were slower than the latency threshold.",
+	})
+)
+
+// instrument wraps `h` so that the duration of each request it serves is
+// recorded with a handler label of `name`.
+func instrument(name string, h http.HandlerFunc) http.Handler {
+	return promhttp.InstrumentHandlerDuration(checkSeconds.MustCurryWith(prometheus.Labels{"handler": name}), h)
+}
+
+// nodeCollector is a prometheus.Collector that queries 'CLUSTER INFO' and 'INFO
+// replication' from the Redis node when metrics are scraped.
+type nodeCollector struct {
+	client  *redis.Client
+	timeout time.Duration
+
+	up                *prometheus.Desc
+	stateOk           *prometheus.Desc
+	slots             *prometheus.Desc
+	knownNodes        *prometheus.Desc
+	size              *prometheus.Desc
+	currentEpoch      *prometheus.Desc
+	myEpoch           *prometheus.Desc
+	messagesSent      *prometheus.Desc
+	messagesReceived  *prometheus.Desc
+	role              *prometheus.Desc
+	connectedReplicas *prometheus.Desc
+	primaryLinkUp     *prometheus.Desc
+}
+
+// newNodeCollector returns a nodeCollector that queries the Redis node with
+// `client`, waiting no longer than `timeout` for each scrape.
+func newNodeCollector(client *redis.Client, timeout time.Duration) *nodeCollector {
+	desc := func(name string, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc("attache_check_"+name, help, labels, nil)
+	}
+	return &nodeCollector{
+		client:            client,
+		timeout:           timeout,
+		up:                desc("redis_up", "1 if the Redis node could be queried, otherwise 0."),
+		stateOk:           desc("cluster_state_ok", "1 if 'cluster_state' is 'ok', otherwise 0."),
+		slots:             desc("cluster_slots", "Count of shard slots by state ('assigned', 'ok', 'pfail' or 'fail').", "state"),
+		knownNodes:        desc("cluster_known_nodes", "Count of nodes known to the Redis node."),
+		size:              desc("cluster_size", "Count of shard primaries serving at least one shard slot."),
+		currentEpoch:      desc("cluster_current_epoch", "The current epoch of the cluster."),
+		myEpoch:           desc("cluster_my_epoch", "The config epoch of the Redis node."),
+		messagesSent:      desc("cluster_messages_sent_total", "Count of messages sent via the cluster bus."),
+		messagesReceived:  desc("cluster_messages_received_total", "Count of messages received via the cluster bus."),
+		role:              desc("node_role", "1 for the current role ('primary' or 'replica') of the Redis node.", "role"),
+		connectedReplicas: desc("connected_replicas", "Count of replicas connected to the Redis node, if it's a primary."),
+		primaryLinkUp:     desc("primary_link_up", "1 if the link to the primary is up, otherwise 0, if the Redis node is a replica."),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *nodeCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{
+		c.up, c.stateOk, c.slots, c.knownNodes, c.size, c.currentEpoch, c.myEpoch,
+		c.messagesSent, c.messagesReceived, c.role, c.connectedReplicas, c.primaryLinkUp,
+	} {
+		ch <- d
+	}
+}
+
+// boolValue returns 1 if `b` is true, otherwise 0.
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Collect implements prometheus.Collector.
+func (c *nodeCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	info, err := c.client.GetClusterInfo(ctx)
+	if err != nil {
+		logger.Errorf("collecting metrics: %s", err)
+		ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, 0)
+		return
+	}
+	replication, err := c.client.GetReplicationInfo(ctx)
+	if err != nil {
+		logger.Errorf("collecting metrics: %s", err)
+		ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, 0)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, 1)
+
+	gauge := func(d *prometheus.Desc, v int64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, float64(v), labels...)
+	}
+	ch <- prometheus.MustNewConstMetric(c.stateOk, prometheus.GaugeValue, boolValue(info.State == "ok"))
+	gauge(c.slots, info.SlotsAssigned, "assigned")
+	gauge(c.slots, info.SlotsOk, "ok")
+	gauge(c.slots, info.SlotsPfail, "pfail")
+	gauge(c.slots, info.SlotsFail, "fail")
+	gauge(c.knownNodes, info.KnownNodes)
+	gauge(c.size, info.Size)
+	gauge(c.currentEpoch, info.CurrentEpoch)
+	gauge(c.myEpoch, info.MyEpoch)
+	ch <- prometheus.MustNewConstMetric(c.messagesSent, prometheus.CounterValue, float64(info.StatsMessagesSent))
+	ch <- prometheus.MustNewConstMetric(c.messagesReceived, prometheus.CounterValue, float64(info.StatsMessagesReceived))
+
+	isReplica := replication.Role == "slave"
+	ch <- prometheus.MustNewConstMetric(c.role, prometheus.GaugeValue, boolValue(!isReplica), "primary")
+	ch <- prometheus.MustNewConstMetric(c.role, prometheus.GaugeValue, boolValue(isReplica), "replica")
+	if isReplica {
+		ch <- prometheus.MustNewConstMetric(c.primaryLinkUp, prometheus.GaugeValue, boolValue(replication.PrimaryLinkStatus == "up"))
+	} else {
+		gauge(c.connectedReplicas, replication.ConnectedReplicas)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	redis "github.com/letsencrypt/attache/src/redis/client"
+)
+
+// probeKeyTTL is the time after which a key written by a probe expires.
+const probeKeyTTL = 10 * time.Second
+
+// probeOpts configure the synthetic read/write probe.
+type probeOpts struct {
+	// keyPrefix is the prefix of every key written by a probe. The probe is
+	// disabled if it's empty.
+	keyPrefix string
+
+	// maxLatency is the round-trip latency above which a probe fails.
+	maxLatency time.Duration
+}
+
+// probeSlots returns the shard slot ranges that the node marked myself in
+// `nodes` can serve probes for and true if it's a replica. The ranges of a
+// replica are those of its primary.
+func probeSlots(nodes []redis.ClusterNode) ([]redis.SlotRange, bool, error) {
+	var myself *redis.ClusterNode
+	for i := range nodes {
+		if nodes[i].IsMyself() {
+			myself = &nodes[i]
+			break
+		}
+	}
+	if myself == nil {
+		return nil, false, errors.New("no node is marked myself")
+	}
+	if !myself.IsReplica() {
+		return myself.Slots, false, nil
+	}
+	for _, n := range nodes {
+		if n.ID == myself.PrimaryID {
+			return n.Slots, true, nil
+		}
+	}
+	return nil, true, fmt.Errorf("primary %q is unknown", myself.PrimaryID)
+}
+
+// Probe handles synthetic probe requests. It writes and then reads a key, with
+// a short TTL, that maps to a shard slot served by this node. Replicas only
+// read the key, in a shard slot served by their primary. A 200 response means
+// that the probe succeeded within the latency threshold and a 503 response
+// means that it failed or was too slow. The body includes the round-trip
+// latency.
+func (h *CheckHandler) Probe(w http.ResponseWriter, r *http.Request) {
+	h.respond(w, r, h.probe)
+}
+
+func (h *CheckHandler) probe(ctx context.Context, query url.Values) checkResult {
+	nodes, err := h.GetClusterNodes(ctx)
+	if err != nil {
+		checkErrors.WithLabelValues("probe").Inc()
+		return textResult(http.StatusInternalServerError, "Unable to get the nodes known to %q: %s", h.NodeAddr, err)
+	}
+
+	ranges, isReplica, err := probeSlots(nodes)
+	if err != nil {
+		probeFailures.Inc()
+		return textResult(http.StatusServiceUnavailable, "probe failed: %s", err)
+	}
+
+	key, slot, ok := redis.KeyInSlots(h.probeOpts.keyPrefix, ranges)
+	if !ok {
+		// An empty primary, or a replica of one, has no shard slots to serve.
+		return textResult(http.StatusOK, "skipped, no shard slots are served by this node")
+	}
+
+	start := time.Now()
+	if isReplica {
+		err = h.ProbeRead(ctx, key)
+	} else {
+		err = h.ProbeWrite(ctx, key, probeKeyTTL)
+	}
+	latency := time.Since(start)
+	probeSeconds.Observe(latency.Seconds())
+
+	if err != nil {
+		probeFailures.Inc()
+		return textResult(http.StatusServiceUnavailable, "probe of key %q (slot %d) failed after %s: %s", key, slot, latency, err)
+	}
+	if latency > h.probeOpts.maxLatency {
+		probeFailures.Inc()
+		return textResult(http.StatusServiceUnavailable, "probe of key %q (slot %d) took %s, longer than %s", key, slot, latency, h.probeOpts.maxLatency)
+	}
+	return textResult(http.StatusOK, "probe of key %q (slot %d) took %s", key, slot, latency)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	redis "github.com/letsencrypt/attache/src/redis/client"
+)
+
+func Test_probeSlots(t *testing.T) {
+	primary := redis.ClusterNode{ID: "a", Flags: []string{"master"}, Slots: []redis.SlotRange{{Start: 0, End: 8191}}}
+	tests := []struct {
+		name          string
+		nodes         []redis.ClusterNode
+		want          []redis.SlotRange
+		wantIsReplica bool
+		wantErr       bool
+	}{
+		{
+			"primary",
+			[]redis.ClusterNode{
+				{ID: "b", Flags: []string{"myself", "master"}, Slots: []redis.SlotRange{{Start: 8192, End: 16383}}},
+				primary,
+			},
+			[]redis.SlotRange{{Start: 8192, End: 16383}},
+			false,
+			false,
+		},
+		{
+			"replica",
+			[]redis.ClusterNode{
+				primary,
+				{ID: "b", Flags: []string{"myself", "slave"}, PrimaryID: "a"},
+			},
+			[]redis.SlotRange{{Start: 0, End: 8191}},
+			true,
+			false,
+		},
+		{
+			"replica of unknown primary",
+			[]redis.ClusterNode{{ID: "b", Flags: []string{"myself", "slave"}, PrimaryID: "c"}},
+			nil,
+			true,
+			true,
+		},
+		{
+			"no myself",
+			[]redis.ClusterNode{primary},
+			nil,
+			false,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, isReplica, err := probeSlots(tt.nodes)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("probeSlots() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) || isReplica != tt.wantIsReplica {
+				t.Errorf("probeSlots() = %v, %t, want %v, %t", got, isReplica, tt.want, tt.wantIsReplica)
+			}
+		})
+	}
+}
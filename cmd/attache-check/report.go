@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	redis "github.com/letsencrypt/attache/src/redis/client"
+)
+
+// peer is a node known to the Redis node, as described in a health report.
+type peer struct {
+	ID        string   `json:"id"`
+	Addr      string   `json:"addr"`
+	Flags     []string `json:"flags"`
+	PrimaryID string   `json:"primary-id,omitempty"`
+	LinkState string   `json:"link-state"`
+}
+
+// healthReport describes the Redis node and the result of each health rule. A
+// node is healthy unless a rule failed with a status of critical.
+type healthReport struct {
+	Healthy     bool               `json:"healthy"`
+	Status      status             `json:"status,omitempty"`
+	Error       string             `json:"error,omitempty"`
+	NodeAddr    string             `json:"node-addr"`
+	NodeID      string             `json:"node-id,omitempty"`
+	Role        string             `json:"role,omitempty"`
+	PrimaryID   string             `json:"primary-id,omitempty"`
+	PrimaryAddr string             `json:"primary-addr,omitempty"`
+	Slots       []redis.SlotRange  `json:"slots,omitempty"`
+	ClusterInfo *redis.ClusterInfo `json:"cluster-info,omitempty"`
+	Peers       []peer             `json:"peers,omitempty"`
+	Rules       []ruleResult       `json:"rules,omitempty"`
+}
+
+// makeReport returns the health report of the node at `nodeAddr` from the
+// result of evaluating `rules` against its state `s` and its view of the
+// cluster `nodes`.
+func makeReport(nodeAddr string, rules []rule, s nodeState, nodes []redis.ClusterNode) healthReport {
+	report := healthReport{NodeAddr: nodeAddr, ClusterInfo: s.info}
+	report.Rules, report.Status = evaluateRules(rules, s)
+	report.Healthy = report.Status != statusCritical
+
+	addrs := make(map[string]string)
+	for _, n := range nodes {
+		addrs[n.ID] = n.Addr
+	}
+	for _, n := range nodes {
+		if n.IsMyself() {
+			report.NodeID = n.ID
+			report.Slots = n.Slots
+			report.PrimaryID = n.PrimaryID
+			report.PrimaryAddr = addrs[n.PrimaryID]
+			if n.IsReplica() {
+				report.Role = "replica"
+			} else {
+				report.Role = "primary"
+			}
+			continue
+		}
+		report.Peers = append(report.Peers, peer{
+			ID:        n.ID,
+			Addr:      n.Addr,
+			Flags:     n.Flags,
+			PrimaryID: n.PrimaryID,
+			LinkState: n.LinkState,
+		})
+	}
+	return report
+}
+
+// Report handles requests from operators for a JSON health report describing
+// this Redis Cluster node, its view of the cluster, and the result of each
+// health rule. Optional rules are requested as they are for StateOk. The status
+// code comes from the report's own evaluation of the rules, which isn't damped.
+func (h *CheckHandler) Report(w http.ResponseWriter, r *http.Request) {
+	h.respond(w, r, h.report)
+}
+
+func (h *CheckHandler) report(ctx context.Context, query url.Values) checkResult {
+	rules, err := selectRules(h.rules, query)
+	if err != nil {
+		return jsonResult(http.StatusBadRequest, healthReport{NodeAddr: h.NodeAddr, Error: err.Error()})
+	}
+
+	info, err := h.GetClusterInfo(ctx)
+	if err != nil {
+		checkErrors.WithLabelValues("report").Inc()
+		return jsonResult(http.StatusInternalServerError, healthReport{NodeAddr: h.NodeAddr, Error: fmt.Sprintf("Unable to connect to node %q: %s", h.NodeAddr, err)})
+	}
+
+	nodes, err := h.GetClusterNodes(ctx)
+	if err != nil {
+		checkErrors.WithLabelValues("report").Inc()
+		return jsonResult(http.StatusInternalServerError, healthReport{NodeAddr: h.NodeAddr, Error: fmt.Sprintf("Unable to get the nodes known to %q: %s", h.NodeAddr, err)})
+	}
+
+	s := nodeState{info: info, series: seriesKey("report", rules)}
+	err = h.gatherState(ctx, rules, &s)
+	if err != nil {
+		checkErrors.WithLabelValues("report").Inc()
+		return jsonResult(http.StatusInternalServerError, healthReport{NodeAddr: h.NodeAddr, Error: fmt.Sprintf("Unable to check node %q: %s", h.NodeAddr, err)})
+	}
+
+	report := makeReport(h.NodeAddr, rules, s, nodes)
+	return jsonResult(report.Status.code(), report)
+}
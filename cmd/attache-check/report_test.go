@@ -0,0 +1,75 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	redis "github.com/letsencrypt/attache/src/redis/client"
+)
+
+func Test_makeReport(t *testing.T) {
+	nodes := []redis.ClusterNode{
+		{ID: "a", Addr: "10.0.0.1:6379", Flags: []string{"master"}, LinkState: "connected", Slots: []redis.SlotRange{{Start: 0, End: 16383}}},
+		{ID: "b", Addr: "10.0.0.2:6379", Flags: []string{"myself", "slave"}, PrimaryID: "a", LinkState: "connected"},
+		{ID: "c", Addr: "10.0.0.3:6379", Flags: []string{"slave", "fail"}, PrimaryID: "a", LinkState: "disconnected"},
+	}
+
+	tests := []struct {
+		name string
+		info redis.ClusterInfo
+		want healthReport
+	}{
+		{
+			"healthy replica",
+			redis.ClusterInfo{State: "ok"},
+			healthReport{
+				Healthy:     true,
+				Status:      statusPassing,
+				NodeAddr:    "10.0.0.2:6379",
+				NodeID:      "b",
+				Role:        "replica",
+				PrimaryID:   "a",
+				PrimaryAddr: "10.0.0.1:6379",
+				Peers: []peer{
+					{ID: "a", Addr: "10.0.0.1:6379", Flags: []string{"master"}, LinkState: "connected"},
+					{ID: "c", Addr: "10.0.0.3:6379", Flags: []string{"slave", "fail"}, PrimaryID: "a", LinkState: "disconnected"},
+				},
+				Rules: []ruleResult{{Name: "cluster-state-ok", Passed: true, Status: statusPassing}},
+			},
+		},
+		{
+			"cluster state fail",
+			redis.ClusterInfo{State: "fail"},
+			healthReport{
+				Healthy:     false,
+				Status:      statusCritical,
+				NodeAddr:    "10.0.0.2:6379",
+				NodeID:      "b",
+				Role:        "replica",
+				PrimaryID:   "a",
+				PrimaryAddr: "10.0.0.1:6379",
+				Peers: []peer{
+					{ID: "a", Addr: "10.0.0.1:6379", Flags: []string{"master"}, LinkState: "connected"},
+					{ID: "c", Addr: "10.0.0.3:6379", Flags: []string{"slave", "fail"}, PrimaryID: "a", LinkState: "disconnected"},
+				},
+				Rules: []ruleResult{{Name: "cluster-state-ok", Passed: false, Status: statusCritical, Message: `cluster_state is "fail"`}},
+			},
+		},
+	}
+	var rules []rule
+	for _, r := range newRules(ruleOpts{}) {
+		if r.name == "cluster-state-ok" {
+			rules = append(rules, r)
+		}
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := tt.info
+			tt.want.ClusterInfo = &info
+			got := makeReport("10.0.0.2:6379", rules, nodeState{info: &info}, nodes)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("makeReport() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,563 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	redis "github.com/letsencrypt/attache/src/redis/client"
+	logger "github.com/sirupsen/logrus"
+)
+
+// nodeState is the state of the Redis node that health rules are evaluated
+// against.
+type nodeState struct {
+	info *redis.ClusterInfo
+
+	// series identifies the series of checks, made by a single check path with
+	// the same rules, that this state is gathered for. State that's relative to
+	// the previous check is relative to the previous check in this series.
+	series string
+
+	// replication is only gathered for rules that need it.
+	replication *redis.ReplicationInfo
+
+	// primaryOffset is the replication offset of the primary of this node. It's
+	// only gathered if this node is a replica with a link to its primary that's
+	// up and not syncing.
+	primaryOffset int64
+
+	// memory and clients are only gathered for rules that need them.
+	memory  *redis.MemoryInfo
+	clients *redis.ClientsInfo
+
+	// maxClientsErr is why maxclients couldn't be read with 'CONFIG GET', if
+	// it isn't reported in 'INFO clients' and that failed.
+	maxClientsErr error
+
+	// persistence is only gathered for rules that need it.
+	persistence *redis.PersistenceInfo
+
+	// rejectedConnections is the number of connections rejected by this node,
+	// because it had reached maxclients, since the previous check in the
+	// series.
+	rejectedConnections int64
+}
+
+// status is the result of a health rule, or of every health rule, using the
+// names of Consul's check states.
+type status string
+
+const (
+	statusPassing  status = "passing"
+	statusWarning  status = "warning"
+	statusCritical status = "critical"
+)
+
+// code returns the HTTP status code that Consul maps to `s`.
+func (s status) code() int {
+	switch s {
+	case statusPassing:
+		return http.StatusOK
+	case statusWarning:
+		return http.StatusTooManyRequests
+	}
+	return http.StatusServiceUnavailable
+}
+
+// warningError is returned by the check of a health rule that failed with a
+// status of warning, rather than critical.
+type warningError struct {
+	msg string
+}
+
+func (e *warningError) Error() string {
+	return e.msg
+}
+
+// warnf returns a *warningError with a message formatted like fmt.Errorf.
+func warnf(format string, a ...interface{}) error {
+	return &warningError{fmt.Sprintf(format, a...)}
+}
+
+// thresholdErr returns an error with a message formatted from `format` and
+// `a` if `value` is at least `critical`, a warning if it's at least `warning`,
+// or nil if it's below both. A threshold of 0 is disabled.
+func thresholdErr(value, warning, critical float64, format string, a ...interface{}) error {
+	switch {
+	case critical > 0 && value >= critical:
+		return fmt.Errorf(format, a...)
+	case warning > 0 && value >= warning:
+		return warnf(format, a...)
+	}
+	return nil
+}
+
+// rule is a single health rule. A node is healthy when every rule passes.
+type rule struct {
+	// name identifies the rule in health reports and the 'rule' query
+	// parameter.
+	name string
+
+	// optional rules are only evaluated when requested by name with the 'rule'
+	// query parameter.
+	optional bool
+
+	// gather, if set, adds any state that check needs, beyond 'CLUSTER INFO',
+	// to `s`.
+	gather func(ctx context.Context, h *CheckHandler, s *nodeState) error
+
+	// check returns an error describing why the rule failed, or nil if it
+	// passed. The rule fails with a status of warning if the error is a
+	// *warningError, otherwise critical.
+	check func(s nodeState) error
+}
+
+// ruleOpts are the thresholds used by health rules.
+type ruleOpts struct {
+	// replicaMaxLag is the number of bytes a replica's replication offset may
+	// lag behind that of its primary.
+	replicaMaxLag int64
+
+	// The following are the thresholds at which a rule fails with a status of
+	// warning or critical. Ratios are of the limit configured for the Redis
+	// node. A threshold of 0 is disabled.
+	memoryWarningRatio          float64
+	memoryCriticalRatio         float64
+	clientsWarningRatio         float64
+	clientsCriticalRatio        float64
+	blockedClientsWarning       int64
+	blockedClientsCritical      int64
+	rejectedConnectionsWarning  int64
+	rejectedConnectionsCritical int64
+
+	// persistenceErrorsCritical causes the 'persistence-ok' rule to fail with
+	// a status of critical, rather than warning.
+	persistenceErrorsCritical bool
+}
+
+// validate returns an error if any warning threshold in `o` is greater than the
+// corresponding critical threshold.
+func (o ruleOpts) validate() error {
+	for _, t := range []struct {
+		name              string
+		warning, critical float64
+	}{
+		{"memory", o.memoryWarningRatio, o.memoryCriticalRatio},
+		{"clients", o.clientsWarningRatio, o.clientsCriticalRatio},
+		{"blocked-clients", float64(o.blockedClientsWarning), float64(o.blockedClientsCritical)},
+		{"rejected-connections", float64(o.rejectedConnectionsWarning), float64(o.rejectedConnectionsCritical)},
+	} {
+		if t.warning < 0 || t.critical < 0 {
+			return fmt.Errorf("%s thresholds must not be negative", t.name)
+		}
+		if t.warning > 0 && t.critical > 0 && t.warning > t.critical {
+			return fmt.Errorf("%s warning threshold %g is greater than the critical threshold %g", t.name, t.warning, t.critical)
+		}
+	}
+	return nil
+}
+
+// newRules returns the health rules, in the order they're evaluated, using the
+// thresholds in `opts`.
+func newRules(opts ruleOpts) []rule {
+	return []rule{
+		{
+			name: "cluster-state-ok",
+			check: func(s nodeState) error {
+				if s.info.State != "ok" {
+					return fmt.Errorf("cluster_state is %q", s.info.State)
+				}
+				return nil
+			},
+		},
+		{
+			name:     "replica-synced",
+			optional: true,
+			gather:   gatherReplication,
+			check: func(s nodeState) error {
+				return checkReplicaSynced(s, opts.replicaMaxLag)
+			},
+		},
+		{
+			name:     "memory-usage",
+			optional: true,
+			gather:   gatherMemory,
+			check: func(s nodeState) error {
+				if s.memory.MaxMemory == 0 {
+					return nil
+				}
+				ratio := float64(s.memory.UsedMemory) / float64(s.memory.MaxMemory)
+				return thresholdErr(ratio, opts.memoryWarningRatio, opts.memoryCriticalRatio,
+					"used_memory is %.0f%% of maxmemory (%d of %d bytes)", ratio*100, s.memory.UsedMemory, s.memory.MaxMemory)
+			},
+		},
+		{
+			name:     "connected-clients",
+			optional: true,
+			gather:   gatherClients,
+			check: func(s nodeState) error {
+				if s.clients.MaxClients == 0 {
+					if s.maxClientsErr != nil {
+						return fmt.Errorf("maxclients is unknown, it isn't in INFO clients and CONFIG GET maxclients failed: %w", s.maxClientsErr)
+					}
+					return errors.New("maxclients is unknown")
+				}
+				ratio := float64(s.clients.ConnectedClients) / float64(s.clients.MaxClients)
+				return thresholdErr(ratio, opts.clientsWarningRatio, opts.clientsCriticalRatio,
+					"connected_clients is %.0f%% of maxclients (%d of %d)", ratio*100, s.clients.ConnectedClients, s.clients.MaxClients)
+			},
+		},
+		{
+			name:     "blocked-clients",
+			optional: true,
+			gather:   gatherClients,
+			check: func(s nodeState) error {
+				return thresholdErr(float64(s.clients.BlockedClients), float64(opts.blockedClientsWarning), float64(opts.blockedClientsCritical),
+					"blocked_clients is %d", s.clients.BlockedClients)
+			},
+		},
+		{
+			name:     "rejected-connections",
+			optional: true,
+			gather:   gatherClients,
+			check: func(s nodeState) error {
+				return thresholdErr(float64(s.rejectedConnections), float64(opts.rejectedConnectionsWarning), float64(opts.rejectedConnectionsCritical),
+					"%d connections rejected since the previous check", s.rejectedConnections)
+			},
+		},
+		{
+			name:   "not-loading",
+			gather: gatherPersistence,
+			check: func(s nodeState) error {
+				if s.persistence.Loading != 0 {
+					return errors.New("loading is 1, the dataset is still being loaded from disk")
+				}
+				return nil
+			},
+		},
+		{
+			name:     "persistence-ok",
+			optional: true,
+			gather:   gatherPersistence,
+			check: func(s nodeState) error {
+				return checkPersistence(s, opts.persistenceErrorsCritical)
+			},
+		},
+	}
+}
+
+// checkPersistence returns an error listing each of the last RDB save, AOF
+// rewrite and AOF write that failed. The error is a warning unless `critical`.
+func checkPersistence(s nodeState, critical bool) error {
+	var failed []string
+	if s.persistence.RDBLastBgsaveStatus == "err" {
+		failed = append(failed, "rdb_last_bgsave_status is 'err'")
+	}
+	if s.persistence.AOFLastBgrewriteStatus == "err" {
+		failed = append(failed, "aof_last_bgrewrite_status is 'err'")
+	}
+	if s.persistence.AOFLastWriteStatus == "err" {
+		failed = append(failed, "aof_last_write_status is 'err'")
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	if critical {
+		return errors.New(strings.Join(failed, ", "))
+	}
+	return warnf("%s", strings.Join(failed, ", "))
+}
+
+// checkReplicaSynced returns an error if this node is a replica that's not
+// linked to its primary, is still syncing with it, or has a replication offset
+// that lags behind it by more than `maxLag` bytes.
+func checkReplicaSynced(s nodeState, maxLag int64) error {
+	if s.replication.Role != "slave" {
+		return nil
+	}
+	if s.replication.PrimaryLinkStatus != "up" {
+		return fmt.Errorf("master_link_status is %q", s.replication.PrimaryLinkStatus)
+	}
+	if s.replication.PrimarySyncInProgress != 0 {
+		return fmt.Errorf("master_sync_in_progress is %d", s.replication.PrimarySyncInProgress)
+	}
+	lag := s.primaryOffset - s.replication.ReplicaOffset
+	if lag > maxLag {
+		return fmt.Errorf("replication offset lags the primary by %d bytes, more than %d", lag, maxLag)
+	}
+	return nil
+}
+
+// gatherReplication adds the output of 'INFO replication' and, if this node is
+// a replica that's linked to its primary, the replication offset of the
+// primary to `s`.
+func gatherReplication(ctx context.Context, h *CheckHandler, s *nodeState) error {
+	if s.replication != nil {
+		return nil
+	}
+	replication, err := h.GetReplicationInfo(ctx)
+	if err != nil {
+		return err
+	}
+	s.replication = replication
+	if replication.Role != "slave" || replication.PrimaryLinkStatus != "up" || replication.PrimarySyncInProgress != 0 {
+		return nil
+	}
+
+	primaryAddr := net.JoinHostPort(replication.PrimaryHost, replication.PrimaryPort)
+	primary, release, err := h.primaryClient(primaryAddr)
+	if err != nil {
+		return err
+	}
+	defer release()
+	primaryReplication, err := primary.GetReplicationInfo(ctx)
+	if err != nil {
+		return fmt.Errorf("primary %q: %w", primaryAddr, err)
+	}
+	s.primaryOffset = primaryReplication.ReplOffset
+	return nil
+}
+
+// gatherMemory adds the output of 'INFO memory' to `s`.
+func gatherMemory(ctx context.Context, h *CheckHandler, s *nodeState) error {
+	if s.memory != nil {
+		return nil
+	}
+	memory, err := h.GetMemoryInfo(ctx)
+	if err != nil {
+		return err
+	}
+	s.memory = memory
+	return nil
+}
+
+// gatherClients adds the output of 'INFO clients' and the number of
+// connections rejected since the previous check, from 'INFO stats', to `s`. If
+// 'INFO clients' doesn't report maxclients, it's read with 'CONFIG GET'
+// instead, and if that fails the error is added to `s` rather than returned so
+// that only the rule that needs maxclients fails.
+func gatherClients(ctx context.Context, h *CheckHandler, s *nodeState) error {
+	if s.clients != nil {
+		return nil
+	}
+	clients, err := h.GetClientsInfo(ctx)
+	if err != nil {
+		return err
+	}
+	stats, err := h.GetStatsInfo(ctx)
+	if err != nil {
+		return err
+	}
+	if clients.MaxClients == 0 {
+		clients.MaxClients, s.maxClientsErr = h.maxClients(ctx)
+	}
+	s.clients = clients
+	s.rejectedConnections = h.rejectedSincePrevious(s.series, stats.RejectedConnections)
+	return nil
+}
+
+// gatherPersistence adds the output of 'INFO persistence' to `s`.
+func gatherPersistence(ctx context.Context, h *CheckHandler, s *nodeState) error {
+	if s.persistence != nil {
+		return nil
+	}
+	persistence, err := h.GetPersistenceInfo(ctx)
+	if err != nil {
+		return err
+	}
+	s.persistence = persistence
+	return nil
+}
+
+// maxClientsTTL is how long the maxclients read with 'CONFIG GET' is cached.
+const maxClientsTTL = time.Minute
+
+// maxClients returns the client connection limit of this node from 'CONFIG GET
+// maxclients', cached for maxClientsTTL. Failures aren't cached.
+func (h *CheckHandler) maxClients(ctx context.Context) (int64, error) {
+	h.maxClientsMu.Lock()
+	defer h.maxClientsMu.Unlock()
+
+	if h.maxClientsValue != 0 && time.Since(h.maxClientsAt) < maxClientsTTL {
+		return h.maxClientsValue, nil
+	}
+	maxClients, err := h.GetMaxClients(ctx)
+	if err != nil {
+		return 0, err
+	}
+	h.maxClientsValue = maxClients
+	h.maxClientsAt = time.Now()
+	return maxClients, nil
+}
+
+// rejectedSincePrevious records `rejected`, the total number of connections
+// rejected by this node, for the series of checks `series` and returns the
+// number rejected since the total was last recorded for it. Each series keeps
+// its own total so that checks in one series don't hide rejections from
+// another. It returns 0 the first time it's called for a series, or if the
+// total went down because the node restarted.
+func (h *CheckHandler) rejectedSincePrevious(series string, rejected int64) int64 {
+	h.rejectedMu.Lock()
+	defer h.rejectedMu.Unlock()
+
+	previous, seen := h.rejected[series]
+	if h.rejected == nil {
+		h.rejected = make(map[string]int64)
+	}
+	h.rejected[series] = rejected
+	if !seen || rejected < previous {
+		return 0
+	}
+	return rejected - previous
+}
+
+// selectRules returns every rule in `rules` that isn't optional, followed by
+// each optional rule named by a 'rule' parameter in `query`. Rules may be named
+// by repeating the parameter or as a comma separated list.
+func selectRules(rules []rule, query url.Values) ([]rule, error) {
+	requested := make(map[string]bool)
+	for _, value := range query["rule"] {
+		for _, name := range strings.Split(value, ",") {
+			requested[strings.TrimSpace(name)] = true
+		}
+	}
+
+	var selected []rule
+	for _, r := range rules {
+		if !r.optional || requested[r.name] {
+			selected = append(selected, r)
+		}
+		delete(requested, r.name)
+	}
+	for name := range requested {
+		return nil, fmt.Errorf("unknown rule %q", name)
+	}
+	return selected, nil
+}
+
+// ruleNames returns the names of `rules`, in order, as a comma separated list.
+func ruleNames(rules []rule) string {
+	names := make([]string, 0, len(rules))
+	for _, r := range rules {
+		names = append(names, r.name)
+	}
+	return strings.Join(names, ",")
+}
+
+// seriesKey identifies the series of checks made by `check` that evaluate
+// `rules`.
+func seriesKey(check string, rules []rule) string {
+	return check + "?rule=" + ruleNames(rules)
+}
+
+// gatherState adds the state needed by each of `rules` to `s`.
+func (h *CheckHandler) gatherState(ctx context.Context, rules []rule, s *nodeState) error {
+	for _, r := range rules {
+		if r.gather == nil {
+			continue
+		}
+		err := r.gather(ctx, h, s)
+		if err != nil {
+			return fmt.Errorf("gathering state for rule %q: %w", r.name, err)
+		}
+	}
+	return nil
+}
+
+// sharedClient is a client shared by concurrent checks. It's closed once it's
+// been retired and the last check using it has released it.
+type sharedClient struct {
+	client  *redis.Client
+	users   int
+	retired bool
+}
+
+// closeIfUnused closes the client if it's been retired and has no users. It
+// must be called with primaryMu held.
+func (c *sharedClient) closeIfUnused() {
+	if !c.retired || c.users > 0 {
+		return
+	}
+	err := c.client.Client.Close()
+	if err != nil {
+		logger.Warnf("failed to close the client for previous primary %q: %s", c.client.NodeAddr, err)
+	}
+}
+
+// primaryClient returns a client for the primary at `addr`, using the same
+// credentials as the client for this node, and a func that must be called once
+// the caller is done with it. The client is reused across checks until this
+// node is found to replicate a different primary, at which point it's retired
+// and closed once every check using it has released it.
+func (h *CheckHandler) primaryClient(addr string) (*redis.Client, func(), error) {
+	h.primaryMu.Lock()
+	defer h.primaryMu.Unlock()
+
+	if h.primary == nil || h.primaryAddr != addr {
+		opts := h.redisOpts
+		opts.NodeAddr = addr
+		client, err := redis.New(opts)
+		if err != nil {
+			return nil, nil, fmt.Errorf("primary %q: %w", addr, err)
+		}
+		if h.primary != nil {
+			h.primary.retired = true
+			h.primary.closeIfUnused()
+		}
+		h.primaryAddr = addr
+		h.primary = &sharedClient{client: client}
+	}
+
+	shared := h.primary
+	shared.users++
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			h.primaryMu.Lock()
+			defer h.primaryMu.Unlock()
+			shared.users--
+			shared.closeIfUnused()
+		})
+	}
+	return shared.client, release, nil
+}
+
+// ruleResult is the result of evaluating a single health rule.
+type ruleResult struct {
+	Name    string `json:"name"`
+	Passed  bool   `json:"passed"`
+	Status  status `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// evaluateRules evaluates each of `rules` against `s`. It returns the result of
+// each and the overall status, which is the most severe status of any rule.
+func evaluateRules(rules []rule, s nodeState) ([]ruleResult, status) {
+	results := make([]ruleResult, 0, len(rules))
+	overall := statusPassing
+	for _, r := range rules {
+		result := ruleResult{Name: r.name, Passed: true, Status: statusPassing}
+		err := r.check(s)
+		if err != nil {
+			var warning *warningError
+			result.Passed = false
+			result.Status = statusCritical
+			if errors.As(err, &warning) {
+				result.Status = statusWarning
+			}
+			result.Message = err.Error()
+		}
+		if result.Status == statusCritical || (result.Status == statusWarning && overall == statusPassing) {
+			overall = result.Status
+		}
+		results = append(results, result)
+	}
+	return results, overall
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	goredis "github.com/go-redis/redis/v8"
+	redis "github.com/letsencrypt/attache/src/redis/client"
+	"github.com/letsencrypt/attache/src/redis/config"
+)
+
+func Test_checkReplicaSynced(t *testing.T) {
+	tests := []struct {
+		name          string
+		replication   redis.ReplicationInfo
+		primaryOffset int64
+		wantErr       bool
+	}{
+		{"primary", redis.ReplicationInfo{Role: "master", ConnectedReplicas: 1, ReplOffset: 5000}, 0, false},
+		{"synced replica", redis.ReplicationInfo{Role: "slave", PrimaryLinkStatus: "up", ReplicaOffset: 5000}, 5000, false},
+		{"replica lagging within threshold", redis.ReplicationInfo{Role: "slave", PrimaryLinkStatus: "up", ReplicaOffset: 4000}, 5000, false},
+		{"replica lagging beyond threshold", redis.ReplicationInfo{Role: "slave", PrimaryLinkStatus: "up", ReplicaOffset: 3999}, 5000, true},
+		{"replica link down", redis.ReplicationInfo{Role: "slave", PrimaryLinkStatus: "down"}, 0, true},
+		{"replica syncing", redis.ReplicationInfo{Role: "slave", PrimaryLinkStatus: "up", PrimarySyncInProgress: 1}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replication := tt.replication
+			err := checkReplicaSynced(nodeState{replication: &replication, primaryOffset: tt.primaryOffset}, 1000)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkReplicaSynced() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_selectRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    []string
+		wantErr bool
+	}{
+		{"default", "", []string{"a", "c"}, false},
+		{"optional rule", "rule=b", []string{"a", "b", "c"}, false},
+		{"required rule named", "rule=a", []string{"a", "c"}, false},
+		{"comma separated", "rule=b,d", []string{"a", "b", "c", "d"}, false},
+		{"repeated", "rule=d&rule=b", []string{"a", "b", "c", "d"}, false},
+		{"unknown rule", "rule=b&rule=bogus", nil, true},
+	}
+	rules := []rule{{name: "a"}, {name: "b", optional: true}, {name: "c"}, {name: "d", optional: true}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := selectRules(rules, query)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("selectRules() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var names []string
+			for _, r := range got {
+				names = append(names, r.name)
+			}
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("selectRules() = %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func Test_newRulesDefault(t *testing.T) {
+	rules, err := selectRules(newRules(ruleOpts{}), url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, r := range rules {
+		names = append(names, r.name)
+	}
+	want := []string{"cluster-state-ok", "not-loading"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("default rules = %v, want %v", names, want)
+	}
+}
+
+func Test_evaluateRules(t *testing.T) {
+	opts := ruleOpts{
+		memoryWarningRatio:          0.8,
+		memoryCriticalRatio:         0.95,
+		clientsWarningRatio:         0.8,
+		clientsCriticalRatio:        0.95,
+		blockedClientsCritical:      10,
+		rejectedConnectionsWarning:  1,
+		rejectedConnectionsCritical: 100,
+	}
+	tests := []struct {
+		name                string
+		memory              redis.MemoryInfo
+		clients             redis.ClientsInfo
+		rejectedConnections int64
+		persistence         redis.PersistenceInfo
+		want                map[string]status
+		wantOverall         status
+	}{
+		{
+			"no maxmemory",
+			redis.MemoryInfo{UsedMemory: 1 << 30},
+			redis.ClientsInfo{ConnectedClients: 5000, MaxClients: 10000},
+			0,
+			redis.PersistenceInfo{},
+			map[string]status{},
+			statusPassing,
+		},
+		{
+			"unknown maxclients",
+			redis.MemoryInfo{UsedMemory: 10, MaxMemory: 1000},
+			redis.ClientsInfo{ConnectedClients: 20},
+			0,
+			redis.PersistenceInfo{},
+			map[string]status{"connected-clients": statusCritical},
+			statusCritical,
+		},
+		{
+			"below warning",
+			redis.MemoryInfo{UsedMemory: 700, MaxMemory: 1000},
+			redis.ClientsInfo{ConnectedClients: 10, BlockedClients: 9, MaxClients: 10000},
+			0,
+			redis.PersistenceInfo{},
+			map[string]status{},
+			statusPassing,
+		},
+		{
+			"memory and clients warning",
+			redis.MemoryInfo{UsedMemory: 800, MaxMemory: 1000},
+			redis.ClientsInfo{ConnectedClients: 9000, MaxClients: 10000},
+			5,
+			redis.PersistenceInfo{},
+			map[string]status{"memory-usage": statusWarning, "connected-clients": statusWarning, "rejected-connections": statusWarning},
+			statusWarning,
+		},
+		{
+			"memory critical",
+			redis.MemoryInfo{UsedMemory: 990, MaxMemory: 1000},
+			redis.ClientsInfo{ConnectedClients: 9000, MaxClients: 10000},
+			0,
+			redis.PersistenceInfo{},
+			map[string]status{"memory-usage": statusCritical, "connected-clients": statusWarning},
+			statusCritical,
+		},
+		{
+			"blocked clients critical without a warning threshold",
+			redis.MemoryInfo{UsedMemory: 10, MaxMemory: 1000},
+			redis.ClientsInfo{ConnectedClients: 20, BlockedClients: 10, MaxClients: 10000},
+			0,
+			redis.PersistenceInfo{},
+			map[string]status{"blocked-clients": statusCritical},
+			statusCritical,
+		},
+		{
+			"loading",
+			redis.MemoryInfo{UsedMemory: 10, MaxMemory: 1000},
+			redis.ClientsInfo{ConnectedClients: 20, MaxClients: 10000},
+			0,
+			redis.PersistenceInfo{Loading: 1},
+			map[string]status{"not-loading": statusCritical},
+			statusCritical,
+		},
+		{
+			"last bgsave failed",
+			redis.MemoryInfo{UsedMemory: 10, MaxMemory: 1000},
+			redis.ClientsInfo{ConnectedClients: 20, MaxClients: 10000},
+			0,
+			redis.PersistenceInfo{RDBLastBgsaveStatus: "err", AOFLastWriteStatus: "ok"},
+			map[string]status{"persistence-ok": statusWarning},
+			statusWarning,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			memory, clients, persistence := tt.memory, tt.clients, tt.persistence
+			s := nodeState{
+				info:                &redis.ClusterInfo{State: "ok"},
+				memory:              &memory,
+				clients:             &clients,
+				rejectedConnections: tt.rejectedConnections,
+				persistence:         &persistence,
+			}
+			rules, err := selectRules(newRules(opts), url.Values{"rule": {"memory-usage,connected-clients,blocked-clients,rejected-connections,persistence-ok"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			results, overall := evaluateRules(rules, s)
+			for _, result := range results {
+				want, ok := tt.want[result.Name]
+				if !ok {
+					want = statusPassing
+				}
+				if result.Status != want {
+					t.Errorf("evaluateRules() %s = %s (%s), want %s", result.Name, result.Status, result.Message, want)
+				}
+			}
+			if overall != tt.wantOverall {
+				t.Errorf("evaluateRules() overall = %s, want %s", overall, tt.wantOverall)
+			}
+		})
+	}
+}
+
+func TestCheckHandler_rejectedSincePrevious(t *testing.T) {
+	var h CheckHandler
+	for _, tt := range []struct {
+		series   string
+		rejected int64
+		want     int64
+	}{
+		{"state-ok?rule=a", 10, 0},
+		{"state-ok?rule=a", 10, 0},
+		{"state-ok?rule=a", 15, 5},
+		{"report?rule=a", 15, 0},
+		{"state-ok?rule=a,b", 20, 0},
+		{"state-ok?rule=a", 20, 5},
+		{"report?rule=a", 22, 7},
+		{"state-ok?rule=a", 2, 0},
+		{"state-ok?rule=a", 3, 1},
+	} {
+		got := h.rejectedSincePrevious(tt.series, tt.rejected)
+		if got != tt.want {
+			t.Errorf("rejectedSincePrevious(%q, %d) = %d, want %d", tt.series, tt.rejected, got, tt.want)
+		}
+	}
+}
+
+func Test_checkPersistence(t *testing.T) {
+	tests := []struct {
+		name        string
+		persistence redis.PersistenceInfo
+		critical    bool
+		want        string
+		wantWarning bool
+	}{
+		{"ok", redis.PersistenceInfo{RDBLastBgsaveStatus: "ok", AOFLastBgrewriteStatus: "ok", AOFLastWriteStatus: "ok"}, false, "", false},
+		{"bgsave failed", redis.PersistenceInfo{RDBLastBgsaveStatus: "err", AOFLastWriteStatus: "ok"}, false, "rdb_last_bgsave_status is 'err'", true},
+		{"aof failed", redis.PersistenceInfo{RDBLastBgsaveStatus: "ok", AOFLastBgrewriteStatus: "err", AOFLastWriteStatus: "err"}, false, "aof_last_bgrewrite_status is 'err', aof_last_write_status is 'err'", true},
+		{"bgsave failed critical", redis.PersistenceInfo{RDBLastBgsaveStatus: "err"}, true, "rdb_last_bgsave_status is 'err'", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			persistence := tt.persistence
+			err := checkPersistence(nodeState{persistence: &persistence}, tt.critical)
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("checkPersistence() error = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.want {
+				t.Fatalf("checkPersistence() error = %v, want %q", err, tt.want)
+			}
+			var warning *warningError
+			if errors.As(err, &warning) != tt.wantWarning {
+				t.Errorf("checkPersistence() warning = %t, want %t", !tt.wantWarning, tt.wantWarning)
+			}
+		})
+	}
+}
+
+func TestCheckHandler_primaryClient(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	err := os.WriteFile(passwordFile, []byte("password"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &CheckHandler{redisOpts: config.RedisOpts{
+		Username:       "replication-user",
+		PasswordConfig: config.PasswordConfig{PasswordFile: passwordFile},
+		TLSConfig: config.TLSConfig{
+			CACertFile: "../../example/tls/redis/ca-cert.pem",
+			CertFile:   "../../example/tls/attache/redis/cert.pem",
+			KeyFile:    "../../example/tls/attache/redis/key.pem",
+		},
+	}}
+
+	// closed returns true if `c` has been closed. Nothing listens on the
+	// addresses used, so a client that's open fails to connect instead.
+	closed := func(c *redis.Client) bool {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		return errors.Is(c.Client.Ping(ctx).Err(), goredis.ErrClosed)
+	}
+
+	// A check is running against the first primary when a second check finds
+	// that the primary has changed.
+	first, releaseFirst, err := h.primaryClient("127.0.0.1:1")
+	if err != nil {
+		t.Fatalf("primaryClient() error = %v", err)
+	}
+	again, releaseAgain, err := h.primaryClient("127.0.0.1:1")
+	if err != nil {
+		t.Fatalf("primaryClient() error = %v", err)
+	}
+	if again != first {
+		t.Error("primaryClient() didn't reuse the client for an unchanged primary")
+	}
+	releaseAgain()
+
+	second, releaseSecond, err := h.primaryClient("127.0.0.1:2")
+	if err != nil {
+		t.Fatalf("primaryClient() error = %v", err)
+	}
+	if second == first || second.NodeAddr != "127.0.0.1:2" {
+		t.Errorf("primaryClient() = client for %q, want a new client for %q", second.NodeAddr, "127.0.0.1:2")
+	}
+	if closed(first) {
+		t.Error("client for the previous primary was closed while a check was using it")
+	}
+
+	releaseFirst()
+	releaseFirst()
+	if !closed(first) {
+		t.Error("client for the previous primary wasn't closed once released")
+	}
+	releaseSecond()
+	if closed(second) {
+		t.Error("client for the current primary was closed once released")
+	}
+}
@@ -3,9 +3,11 @@ package main
 import (
 	"errors"
 	"flag"
+	"strings"
 	"time"
 
 	c "github.com/letsencrypt/attache/src/consul/config"
+	lockClient "github.com/letsencrypt/attache/src/consul/lock"
 	r "github.com/letsencrypt/attache/src/redis/config"
 )
 
@@ -16,6 +18,23 @@ type cliOpts struct {
 	// operations.
 	lockPath string
 
+	// lockSessionTTL is the TTL of the Consul session used to hold the leader
+	// lock. The lock is released if the session isn't renewed within it.
+	lockSessionTTL time.Duration
+
+	// lockDelay is the duration, after the lock holder's session is
+	// invalidated, during which no other session can acquire the leader lock.
+	lockDelay time.Duration
+
+	// lockSessionChecks is a comma separated list of the IDs of Consul health
+	// checks that the leader lock session is tied to. If any of them becomes
+	// critical the lock is released.
+	lockSessionChecks string
+
+	// journalPath is the Consul KV path used to record the progress of the
+	// operation being applied by the lock holder.
+	journalPath string
+
 	// attemptInterval is duration to wait between attempts to join or create a
 	// cluster.
 	attemptInterval time.Duration
@@ -29,9 +48,34 @@ type cliOpts struct {
 	// nodes will join once they are part of a cluster. This field is required.
 	destServiceName string
 
+	// failureDomainKey is the Consul service or node meta key that describes
+	// the failure domain (e.g. the rack or zone) of each node. When set,
+	// members of the same shard are placed in different failure domains where
+	// possible.
+	failureDomainKey string
+
+	// clusterID, when set, identifies the Redis Cluster under management among
+	// several that share the same Consul services. It's used as the tag that
+	// members of the Consul services must have, and it scopes the scaling
+	// opts, lock and journal KV paths.
+	clusterID string
+
+	// reconcile, when true, causes the lock holder to repair drift in the
+	// cluster, such as failed nodes and orphaned primaries, in addition to
+	// onboarding new nodes and scaling in, once this node has joined it.
+	reconcile bool
+
+	// metricsAddr, when set, is the address that Prometheus metrics are
+	// served at under '/metrics'.
+	metricsAddr string
+
 	// logLevel is the level that Attaché should log at.
 	logLevel string
 
+	// dryRun, when true, causes the plan for this node to be printed as JSON
+	// without acquiring the lock or modifying the cluster.
+	dryRun bool
+
 	// RedisOpts contains the configuration for interacting with the node this
 	// serves as a sidecar to and, if one exists, the Redis Cluster. This field
 	// is required.
@@ -54,16 +98,17 @@ func (c cliOpts) Validate() error {
 		return errors.New("missing required opt: 'await-service-name'")
 	}
 
-	if c.ConsulOpts.TLSCACertFile == "" {
-		return errors.New("missing required opt: 'consul-tls-ca-cert")
+	if c.lockSessionTTL < 10*time.Second || c.lockSessionTTL > 24*time.Hour {
+		return errors.New("invalid opt: 'lock-session-ttl' must be between 10s and 24h")
 	}
 
-	if c.ConsulOpts.TLSCertFile == "" {
-		return errors.New("missing required opt: 'consul-tls-cert")
+	if c.lockDelay < 0 || c.lockDelay > time.Minute {
+		return errors.New("invalid opt: 'lock-delay' must be between 0s and 60s")
 	}
 
-	if c.ConsulOpts.TLSKeyFile == "" {
-		return errors.New("missing required opt: 'consul-tls-key")
+	err := c.ValidateConsul()
+	if err != nil {
+		return err
 	}
 
 	if c.RedisOpts.NodeAddr == "" {
@@ -92,15 +137,76 @@ func (c cliOpts) Validate() error {
 	return nil
 }
 
+// ValidateConsul checks that the opts required to interact with Consul, which
+// are all that the `lock` subcommand needs, were passed via the CLI.
+func (c cliOpts) ValidateConsul() error {
+	if strings.Contains(c.clusterID, "/") {
+		return errors.New("invalid opt: 'cluster-id' must not contain '/'")
+	}
+
+	if c.ConsulOpts.TLSCACertFile == "" {
+		return errors.New("missing required opt: 'consul-tls-ca-cert")
+	}
+
+	if c.ConsulOpts.TLSCertFile == "" {
+		return errors.New("missing required opt: 'consul-tls-cert")
+	}
+
+	if c.ConsulOpts.TLSKeyFile == "" {
+		return errors.New("missing required opt: 'consul-tls-key")
+	}
+	return nil
+}
+
+// lockKey returns the Consul KV path of the leader lock, scoped to the cluster
+// if `c.clusterID` is set.
+func (c cliOpts) lockKey() string {
+	if c.clusterID != "" {
+		return c.lockPath + "/" + c.clusterID
+	}
+	return c.lockPath
+}
+
+// journalKey returns the Consul KV path of the operation journal, scoped to the
+// cluster if `c.clusterID` is set.
+func (c cliOpts) journalKey() string {
+	if c.clusterID != "" {
+		return c.journalPath + "/" + c.clusterID
+	}
+	return c.journalPath
+}
+
+// lockSessionOpts returns the options for the Consul session used to hold the
+// leader lock.
+func (c cliOpts) lockSessionOpts() lockClient.SessionOpts {
+	var checks []string
+	for _, check := range strings.Split(c.lockSessionChecks, ",") {
+		check = strings.TrimSpace(check)
+		if check != "" {
+			checks = append(checks, check)
+		}
+	}
+	return lockClient.SessionOpts{TTL: c.lockSessionTTL, LockDelay: c.lockDelay, Checks: checks}
+}
+
 func ParseFlags() cliOpts {
 	var conf cliOpts
 
 	// CLI
 	flag.StringVar(&conf.lockPath, "lock-kv-path", "service/attache/leader", "Consul KV path to use as a leader lock for Redis Cluster operations")
+	flag.DurationVar(&conf.lockSessionTTL, "lock-session-ttl", 10*time.Second, "TTL of the Consul session used to hold the leader lock, between 10s and 24h (e.g. '10s')")
+	flag.DurationVar(&conf.lockDelay, "lock-delay", 15*time.Second, "Duration after the leader lock is lost during which it can't be acquired by another node, at most 60s (e.g. '15s')")
+	flag.StringVar(&conf.lockSessionChecks, "lock-session-checks", "", "Comma separated IDs of Consul health checks that the leader lock session is tied to, 'serfHealth' when empty")
+	flag.StringVar(&conf.journalPath, "journal-kv-path", "service/attache/journal", "Consul KV path used to record the progress of Redis Cluster operations")
 	flag.DurationVar(&conf.attemptInterval, "attempt-interval", 3*time.Second, "Duration to wait between attempts to join or create a cluster (e.g. '1s')")
 	flag.StringVar(&conf.awaitServiceName, "await-service-name", "", "Consul Service for newly created Redis Cluster Nodes, (required)")
 	flag.StringVar(&conf.destServiceName, "dest-service-name", "", "Consul Service for healthy Redis Cluster Nodes, (required)")
+	flag.StringVar(&conf.clusterID, "cluster-id", "", "Identifies the Redis Cluster among several that share the same Consul services, nodes must be tagged with it")
+	flag.StringVar(&conf.failureDomainKey, "failure-domain-meta-key", "", "Consul service or node meta key that describes the failure domain of each node (e.g. 'rack' or 'zone')")
+	flag.BoolVar(&conf.reconcile, "reconcile", false, "Continuously repair drift in the cluster, such as failed nodes and orphaned primaries, once this node has joined it")
+	flag.StringVar(&conf.metricsAddr, "metrics-addr", "", "Address to serve Prometheus metrics at under '/metrics' (e.g. ':8081'), disabled when empty")
 	flag.StringVar(&conf.logLevel, "log-level", "info", "Set the log level")
+	flag.BoolVar(&conf.dryRun, "dry-run", false, "Print the plan for this node as JSON and exit without modifying the cluster")
 
 	// Redis
 	flag.StringVar(&conf.RedisOpts.NodeAddr, "redis-node-addr", "", "redis-server listening address, (required)")
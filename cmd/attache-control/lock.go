@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	lockClient "github.com/letsencrypt/attache/src/consul/lock"
+)
+
+var errLockUsage = errors.New("usage: attache-control [flags] lock show|release [-yes]")
+
+// describeHolder returns a human readable description of the holder of the
+// lock at `key`, held by `sessionID`, as of `now`. The holder is nil if the
+// lock was acquired by an older version of attache-control.
+func describeHolder(key string, sessionID string, holder *lockClient.Holder, now time.Time) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "key:       %s\n", key)
+	fmt.Fprintf(&b, "session:   %s\n", sessionID)
+	if holder == nil {
+		return b.String()
+	}
+	fmt.Fprintf(&b, "node:      %s\n", holder.NodeAddr)
+	if holder.AllocID != "" {
+		fmt.Fprintf(&b, "alloc-id:  %s\n", holder.AllocID)
+	}
+	if holder.Operation != "" {
+		fmt.Fprintf(&b, "operation: %s\n", holder.Operation)
+	}
+	fmt.Fprintf(&b, "since:     %s (%s ago)\n", holder.Since.Format(time.RFC3339), now.Sub(holder.Since).Round(time.Second))
+	return b.String()
+}
+
+// confirmed prompts for confirmation on `out` and returns true if the line read
+// from `in` is 'yes'.
+func confirmed(in io.Reader, out io.Writer, prompt string) bool {
+	fmt.Fprintf(out, "%s Type 'yes' to confirm: ", prompt)
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false
+	}
+	return strings.TrimSpace(line) == "yes"
+}
+
+// lockCommand implements the `lock` subcommand, which shows the holder of the
+// leader lock and, after confirmation, can forcibly release a stale lock.
+func lockCommand(c cliOpts, args []string) error {
+	if len(args) == 0 {
+		return errLockUsage
+	}
+
+	lock, err := lockClient.New(c.ConsulOpts, c.lockKey(), c.lockSessionOpts())
+	if err != nil {
+		return err
+	}
+
+	sessionID, holder, err := lock.Inspect()
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "show":
+		if sessionID == "" {
+			fmt.Printf("lock %q is not held\n", c.lockKey())
+			return nil
+		}
+		fmt.Print(describeHolder(c.lockKey(), sessionID, holder, time.Now()))
+		return nil
+
+	case "release":
+		flags := flag.NewFlagSet("lock release", flag.ContinueOnError)
+		yes := flags.Bool("yes", false, "Release the lock without asking for confirmation")
+		err := flags.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+
+		if sessionID == "" {
+			fmt.Printf("lock %q is not held\n", c.lockKey())
+			return nil
+		}
+		fmt.Print(describeHolder(c.lockKey(), sessionID, holder, time.Now()))
+		if !*yes && !confirmed(os.Stdin, os.Stdout, "Forcibly releasing the lock abandons any operation in progress, it will be resumed by the next lock holder.") {
+			return errors.New("lock not released")
+		}
+
+		err = lock.ForceRelease(sessionID)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("released lock %q by destroying session %s\n", c.lockKey(), sessionID)
+		return nil
+	}
+	return errLockUsage
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	lockClient "github.com/letsencrypt/attache/src/consul/lock"
+)
+
+func Test_describeHolder(t *testing.T) {
+	since := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := since.Add(90 * time.Second)
+
+	tests := []struct {
+		name   string
+		holder *lockClient.Holder
+		want   string
+	}{
+		{
+			"holder written by an older version",
+			nil,
+			"key:       service/attache/leader\nsession:   s1\n",
+		},
+		{
+			"idle holder",
+			&lockClient.Holder{NodeAddr: "10.0.0.1:6379", Since: since},
+			"key:       service/attache/leader\nsession:   s1\nnode:      10.0.0.1:6379\nsince:     2022-01-01T00:00:00Z (1m30s ago)\n",
+		},
+		{
+			"holder performing an operation",
+			&lockClient.Holder{NodeAddr: "10.0.0.1:6379", AllocID: "a1", Operation: "operation 1, step 1 of 2: meet", Since: since},
+			"key:       service/attache/leader\nsession:   s1\nnode:      10.0.0.1:6379\nalloc-id:  a1\noperation: operation 1, step 1 of 2: meet\nsince:     2022-01-01T00:00:00Z (1m30s ago)\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := describeHolder("service/attache/leader", "s1", tt.holder, now)
+			if got != tt.want {
+				t.Errorf("describeHolder() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_confirmed(t *testing.T) {
+	tests := []struct {
+		input string
+		want  bool
+	}{
+		{"yes\n", true},
+		{"yes", true},
+		{"  yes  \n", true},
+		{"y\n", false},
+		{"no\n", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			var out bytes.Buffer
+			got := confirmed(strings.NewReader(tt.input), &out, "Release?")
+			if got != tt.want {
+				t.Errorf("confirmed(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+			if !strings.HasPrefix(out.String(), "Release?") {
+				t.Errorf("confirmed() prompt = %q", out.String())
+			}
+		})
+	}
+}
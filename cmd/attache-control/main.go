@@ -1,16 +1,18 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
-	"strings"
 	"time"
 
 	consul "github.com/letsencrypt/attache/src/consul/client"
+	"github.com/letsencrypt/attache/src/consul/journal"
 	lockClient "github.com/letsencrypt/attache/src/consul/lock"
-	redisCLI "github.com/letsencrypt/attache/src/redis/cli"
 	redis "github.com/letsencrypt/attache/src/redis/client"
 	"github.com/letsencrypt/attache/src/redis/config"
 	logger "github.com/sirupsen/logrus"
@@ -18,6 +20,18 @@ import (
 
 var errContinue = errors.New("continuing")
 
+// errLockLost is returned when the lock is lost while a cluster operation is in
+// progress.
+var errLockLost = errors.New("lost the lock")
+
+// lockWaitTimeout is the maximum duration to wait for the lock before the plan
+// is made again.
+const lockWaitTimeout = 30 * time.Second
+
+// observeTimeout is the maximum duration to wait for the Redis nodes queried
+// while observing the cluster.
+const observeTimeout = 10 * time.Second
+
 func setLogLevel(level string) {
 	parsedLevel, err := logger.ParseLevel(level)
 	if err != nil {
@@ -26,172 +40,244 @@ func setLogLevel(level string) {
 	logger.SetLevel(parsedLevel)
 }
 
-type leader struct {
-	cliOpts
-	lock         *lockClient.Lock
-	scalingOpts  *consul.ScalingOpts
-	destClient   *consul.Client
-	nodesInDest  []string
-	nodesInAwait []string
-}
-
-func (l *leader) createNewRedisCluster() error {
-	// Check the Consul service catalog for other nodes that are waiting to form
-	// a cluster. We're limiting the scope of our search to nodes in the
-	// awaitClient Consul service that Consul considers healthy.
-	awaitClient, err := consul.New(l.ConsulOpts, l.awaitServiceName)
+// healthyNodes returns the addresses of the healthy nodes in the Consul service
+// of `s` and records the failure domain, read from the meta key `metaKey`, of
+// each in `domains`.
+func healthyNodes(s *consul.Client, metaKey string, domains map[string]string) ([]string, error) {
+	nodes, err := s.GetNodes(true, metaKey)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	var addresses []string
+	for _, n := range nodes {
+		addresses = append(addresses, n.Addr)
+		if n.FailureDomain != "" {
+			domains[n.Addr] = n.FailureDomain
+		}
 	}
+	return addresses, nil
+}
+
+// observe gathers the state of this node, the Consul services, and the cluster
+// that a plan is made from.
+func observe(ctx context.Context, c cliOpts, thisNode *redis.Client, dest *consul.Client, await *consul.Client) (observation, error) {
+	obs := observation{ThisNode: thisNode.NodeAddr, FailureDomains: make(map[string]string)}
 
-	l.nodesInAwait, err = awaitClient.GetNodeAddresses(true)
+	var err error
+	obs.ThisNodeIsNew, err = thisNode.IsNew(ctx)
 	if err != nil {
-		return err
+		return obs, fmt.Errorf("while attempting to check the status of %s: %w", thisNode.NodeAddr, err)
 	}
-	numNodesInAwait := len(l.nodesInAwait)
-	logger.Infof("found %d nodes in consul service %s", numNodesInAwait, l.awaitServiceName)
-
-	// We should only attempt to initialize a new cluster if all of the nodes
-	// that we expect in said cluster have finished starting up and reside in
-	// the awaitService Consul service.
-	if l.scalingOpts.NodesMissing(numNodesInAwait) >= 1 {
-		return fmt.Errorf("still waiting for nodes to startup, releasing lock: %w", errContinue)
-
-	} else {
-		var nodesToCluster []string
-		if l.scalingOpts.ReplicasPerPrimary() == 0 {
-			// This handles a special case for clusters that are started with
-			// less than enough replicas to give at least one to each primary.
-			// Once the first primary only cluster is started and the lock is
-			// released our remaining replica nodes will be able to add
-			// themselves to the newly created cluster.
-			nodesToCluster = l.nodesInAwait[:l.scalingOpts.PrimaryCount]
-		} else {
-			nodesToCluster = l.nodesInAwait
-		}
 
-		logger.Infof("attempting to create a new cluster with nodes %s", strings.Join(nodesToCluster, " "))
-		err := redisCLI.CreateCluster(l.RedisOpts, nodesToCluster, l.scalingOpts.ReplicasPerPrimary())
+	if !obs.ThisNodeIsNew {
+		obs.ClusterNodes, err = thisNode.GetClusterNodes(ctx)
 		if err != nil {
-			return err
+			return obs, err
 		}
-		return nil
-	}
-}
 
-func (l *leader) joinOrCreateRedisCluster() error {
-	logger.Info("attempting to join or create a cluster")
+		// The failure domains of the cluster nodes are needed to place
+		// replicas that are moved between shard primaries, and the healthy
+		// nodes are needed to tell which failed nodes can be forgotten.
+		obs.NodesInDest, err = healthyNodes(dest, c.failureDomainKey, obs.FailureDomains)
+		return obs, err
+	}
 
 	// Check the Consul service catalog for an existing Redis Cluster that we
 	// can join. We're limiting the scope of our search to nodes in the
 	// destService Consul service that Consul considers healthy.
-	var err error
-	l.nodesInDest, err = l.destClient.GetNodeAddresses(true)
+	obs.NodesInDest, err = healthyNodes(dest, c.failureDomainKey, obs.FailureDomains)
 	if err != nil {
-		return err
+		return obs, err
 	}
-	numNodesInDest := len(l.nodesInDest)
 
-	// If no existing nodes can be found with this criteria, we know that we
-	// need to initialize a new cluster.
-	if numNodesInDest <= 0 {
-		err = l.createNewRedisCluster()
+	if len(obs.NodesInDest) == 0 {
+		// Check the Consul service catalog for other nodes that are waiting
+		// to form a cluster. We're limiting the scope of our search to nodes
+		// in the awaitService Consul service that Consul considers healthy.
+		obs.NodesInAwait, err = healthyNodes(await, c.failureDomainKey, obs.FailureDomains)
+		return obs, err
+	}
+
+	if c.failureDomainKey != "" {
+		// This node resides in the await Consul service until it has joined
+		// the cluster, so that's where its failure domain is found.
+		_, err = healthyNodes(await, c.failureDomainKey, obs.FailureDomains)
 		if err != nil {
-			return err
+			return obs, err
 		}
-		logger.Info("new cluster created successfully")
-		return nil
 	}
-	existingClusterNode := l.nodesInDest[0]
-	logger.Infof("found %d cluster nodes in consul service %s", numNodesInDest, l.destServiceName)
 
-	logger.Infof("gathering info from the cluster that %s belongs to", existingClusterNode)
+	existingClusterNode := obs.NodesInDest[0]
 	clusterClient, err := redis.New(config.RedisOpts{
 		NodeAddr:       existingClusterNode,
-		Username:       l.RedisOpts.Username,
-		PasswordConfig: l.RedisOpts.PasswordConfig,
-		TLSConfig:      l.RedisOpts.TLSConfig,
+		Username:       c.RedisOpts.Username,
+		PasswordConfig: c.RedisOpts.PasswordConfig,
+		TLSConfig:      c.RedisOpts.TLSConfig,
 	})
 	if err != nil {
-		return err
+		return obs, err
 	}
+	defer clusterClient.Client.Close()
 
-	primaryNodesInCluster, err := clusterClient.GetPrimaryNodes()
+	obs.ClusterNodes, err = clusterClient.GetClusterNodes(ctx)
+	return obs, err
+}
+
+func attemptLeaderLock(c cliOpts, scaling *consul.ScalingOpts, thisNode *redis.Client, dest *consul.Client, await *consul.Client, j *journal.Journal, lock *lockClient.Lock) (err error) {
+	waitCtx, cancel := context.WithTimeout(context.Background(), lockWaitTimeout)
+	defer cancel()
+	lockAttempts.Inc()
+	err = lock.Acquire(waitCtx, lockClient.Holder{NodeAddr: c.RedisOpts.NodeAddr, AllocID: os.Getenv("NOMAD_ALLOC_ID")})
 	if err != nil {
 		return err
 	}
+	defer lock.Release()
 
-	replicaNodesInCluster, err := clusterClient.GetReplicaNodes()
+	if !lock.Acquired {
+		return fmt.Errorf("another node has held the lock for %s: %w", lockWaitTimeout, errContinue)
+	}
+	logger.Info("acquired the lock")
+	lockAcquisitions.Inc()
+	acquiredAt := time.Now()
+	defer func() {
+		lockHeldSeconds.Observe(time.Since(acquiredAt).Seconds())
+	}()
+
+	// Every change to the cluster is bound to the lock's context so that, if
+	// the lock is lost, no further changes are made. The journal is left in
+	// place for the next lock holder to finish the operation.
+	ctx := lock.Context()
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = fmt.Errorf("%w, operation abandoned: %s", errLockLost, err)
+		}
+	}()
+
+	// A previous lock holder may have died part way through an operation,
+	// which must be finished before any new work is started.
+	e := clusterExecutor{conf: c.RedisOpts, opts: clusterOptions(scaling)}
+	err = resumeOperation(ctx, e, j, lock)
 	if err != nil {
 		return err
 	}
 
-	if len(primaryNodesInCluster) < l.scalingOpts.PrimaryCount {
-		// The current cluster has less than the expected shard primary nodes.
-		// This node should be added as a new primary and the existing cluster
-		// shardslots should be rebalanced.
-		logger.Infof("%s should be added as a shard primary", l.RedisOpts.NodeAddr)
-		logger.Infof("attempting to add %s to the cluster that %s belongs to", l.RedisOpts.NodeAddr, existingClusterNode)
-		err := redisCLI.AddNewShardPrimary(l.RedisOpts, existingClusterNode)
-		if err != nil {
-			return err
-		}
-		logger.Infof("%s was successfully added as a shard primary", l.RedisOpts.NodeAddr)
-		return nil
-
-	} else if len(replicaNodesInCluster) < l.scalingOpts.ReplicaCount {
-		// All expected shard primary nodes exist in the current cluster. This
-		// node should be added as a replica to the primary node with the least
-		// number of replicas.
-		logger.Infof("%s should be added as a new shard replica", l.RedisOpts.NodeAddr)
-		logger.Infof("attempting to add %s to the cluster that %s belongs to", l.RedisOpts.NodeAddr, existingClusterNode)
-		err := redisCLI.AddNewShardReplica(l.RedisOpts, existingClusterNode)
-		if err != nil {
-			return err
-		}
-		logger.Infof("%s was successfully added as a shard replica", l.RedisOpts.NodeAddr)
-		return nil
+	// Another node may have modified the cluster while we were waiting for
+	// the lock, so the plan must be made again.
+	obs, err := observe(ctx, c, thisNode, dest, await)
+	if err != nil {
+		return err
 	}
 
-	clusterNodesCount := len(primaryNodesInCluster) + len(replicaNodesInCluster)
-	if l.scalingOpts.NodesMissing(clusterNodesCount) == 0 {
-		// This will only happen when the Nomad job is scaled without a
-		// corresponding change to the scaling opts in Consul.
-		return fmt.Errorf("%s Nomad group count was scaled without a corresponding change to scaling opts", l.RedisOpts.NodeAddr)
+	p, err := makePlan(obs, scaling, c.reconcile)
+	if err != nil {
+		return err
+	}
+	if len(p.Steps) == 0 {
+		return fmt.Errorf("cluster no longer needs to be modified, releasing lock: %w", errContinue)
 	}
 
-	// This should never happen.
-	return fmt.Errorf("%s couldn't be added to an existing cluster", l.RedisOpts.NodeAddr)
+	op, err := newOperation(p)
+	if err != nil {
+		return err
+	}
+	return op.apply(ctx, e, j, lock)
 }
 
-func attemptLeaderLock(c cliOpts, scaling *consul.ScalingOpts, dest *consul.Client) error {
-	lock, err := lockClient.New(c.ConsulOpts, c.lockPath, "10s")
+// printPlan makes a plan and prints it to stdout as JSON without acquiring the
+// lock or modifying the cluster.
+func printPlan(c cliOpts, scaling *consul.ScalingOpts, thisNode *redis.Client, dest *consul.Client, await *consul.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), observeTimeout)
+	defer cancel()
+	obs, err := observe(ctx, c, thisNode, dest, await)
 	if err != nil {
 		return err
 	}
 
-	err = lock.Acquire()
+	p, err := makePlan(obs, scaling, c.reconcile)
+	if err != nil {
+		if !errors.Is(err, errContinue) {
+			return err
+		}
+		logger.Info(err)
+	}
+
+	out, err := json.MarshalIndent(p, "", "  ")
 	if err != nil {
 		return err
 	}
-	defer lock.Cleanup()
+	fmt.Println(string(out))
+	return nil
+}
 
-	if !lock.Acquired {
-		return fmt.Errorf("another node currently has the lock: %w", errContinue)
+// attemptChanges observes this node and the cluster, makes a plan and, if
+// there's anything to do or an interrupted operation to finish, attempts to
+// acquire the lock and apply it. It returns true if this node has joined a
+// cluster and, second, true if there was nothing to do: the plan was empty and
+// no interrupted operation was found.
+func attemptChanges(c cliOpts, scaling *consul.ScalingOpts, thisNode *redis.Client, dest *consul.Client, await *consul.Client, j *journal.Journal, lock *lockClient.Lock) (bool, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), observeTimeout)
+	obs, err := observe(ctx, c, thisNode, dest, await)
+	cancel()
+	if err != nil {
+		errorsTotal.WithLabelValues("observe").Inc()
+		logger.Error(err)
+		return false, false
 	}
+	joined := !obs.ThisNodeIsNew
+	recordObservation(obs, scaling)
 
-	logger.Info("acquired the lock")
-	leader := &leader{
-		cliOpts:     c,
-		lock:        lock,
-		scalingOpts: scaling,
-		destClient:  dest,
+	p, err := makePlan(obs, scaling, c.reconcile)
+	if err == nil && len(p.Steps) == 0 {
+		var interrupted operation
+		found, err := j.Load(&interrupted)
+		if err != nil {
+			errorsTotal.WithLabelValues("journal").Inc()
+			logger.Error(err)
+			return joined, false
+		}
+		if !found {
+			return joined, true
+		}
+		logger.Warnf("operation %s was interrupted, attempting to finish it", interrupted.ID)
+	}
+	if err != nil {
+		if errors.Is(err, errContinue) {
+			logger.Info(err)
+			return joined, false
+		}
+		errorsTotal.WithLabelValues("plan").Inc()
+		logger.Errorf("while attempting to plan changes to the cluster: %s", err)
+		return joined, false
+	}
+
+	err = attemptLeaderLock(c, scaling, thisNode, dest, await, j, lock)
+	if err != nil {
+		if errors.Is(err, errContinue) {
+			logger.Info(err)
+			return joined, false
+		}
+		errorsTotal.WithLabelValues(errorClass(err)).Inc()
+		logger.Errorf("while attempting to modify the cluster: %s", err)
 	}
-	return leader.joinOrCreateRedisCluster()
+	return joined, false
 }
 
 func main() {
 	c := ParseFlags()
+	if flag.Arg(0) == "lock" {
+		err := c.ValidateConsul()
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		err = lockCommand(c, flag.Args()[1:])
+		if err != nil {
+			logger.Fatal(err)
+		}
+		return
+	}
+
 	err := c.Validate()
 	if err != nil {
 		logger.Fatal(err)
@@ -207,17 +293,54 @@ func main() {
 	}
 
 	logger.Info("initializing a new consul client")
-	dest, err := consul.New(c.ConsulOpts, c.destServiceName)
+	dest, err := consul.New(c.ConsulOpts, c.destServiceName, c.clusterID)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	await, err := consul.New(c.ConsulOpts, c.awaitServiceName, c.clusterID)
 	if err != nil {
 		logger.Fatal(err)
 	}
 
-	logger.Infof("fetching scaling options from consul path 'service/%s/scaling'", c.destServiceName)
-	scaling, err := dest.GetScalingOpts()
+	j, err := journal.New(c.ConsulOpts, c.journalKey())
 	if err != nil {
 		logger.Fatal(err)
 	}
 
+	if c.dryRun {
+		logger.Infof("fetching scaling options from consul path '%s'", dest.ScalingOptsKey())
+		scaling, err := dest.GetScalingOpts()
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		err = printPlan(c, scaling, thisNode, dest, await)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		return
+	}
+
+	if c.metricsAddr != "" {
+		logger.Infof("serving metrics at %s/metrics", c.metricsAddr)
+		go serveMetrics(c.metricsAddr)
+	}
+
+	// The lock, and the session used to hold it, are reused by every attempt
+	// to modify the cluster.
+	lock, err := lockClient.New(c.ConsulOpts, c.lockKey(), c.lockSessionOpts())
+	if err != nil {
+		logger.Fatal(err)
+	}
+	defer lock.Cleanup()
+
+	logger.Infof("watching scaling options at consul path '%s'", dest.ScalingOptsKey())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	scalingUpdates := make(chan *consul.ScalingOpts)
+	go dest.WatchScalingOpts(ctx, scalingUpdates)
+
 	catchSignals := make(chan os.Signal, 1)
 	signal.Notify(catchSignals, os.Interrupt)
 
@@ -225,6 +348,32 @@ func main() {
 	done := make(chan bool, 1)
 
 	go func() {
+		var scaling *consul.ScalingOpts
+
+		// ticking is false once this node has joined a cluster and, unless
+		// reconciling, there's nothing left to do. Until the scaling opts
+		// change there's no reason to observe the cluster again.
+		ticking := true
+		var joined bool
+		settle := func(nowJoined, idle bool) {
+			if nowJoined && !joined {
+				logger.Info("this node is already part of an existing cluster")
+				if c.reconcile {
+					logger.Infof("reconciling the cluster against the scaling options every %s", c.attemptInterval)
+				}
+			}
+			joined = nowJoined
+			if joined && idle && !c.reconcile && ticking {
+				// Run until killed, due to
+				// https://github.com/hashicorp/nomad/issues/10058, but keep
+				// watching for changes to the scaling opts that call for the
+				// cluster to be scaled in.
+				logger.Info("this node is part of a cluster that matches the scaling options, waiting for them to change")
+				ticker.Stop()
+				ticking = false
+			}
+		}
+
 		for {
 			select {
 			case <-done:
@@ -236,31 +385,31 @@ func main() {
 				ticker.Stop()
 				done <- true
 
-			case <-ticker.C:
-				// Attempt to create or modify a cluster.
-				thisNodeIsNew, err := thisNode.IsNew()
-				if err != nil {
-					logger.Errorf("while attempting to check that status of %s: %s", c.RedisOpts.NodeAddr, err)
+			case scaling = <-scalingUpdates:
+				if scaling == nil {
+					logger.Error("scaling options are invalid, refusing to act until they're fixed")
 					continue
 				}
-				if !thisNodeIsNew {
-					logger.Info("this node is already part of an existing cluster")
 
-					// Stop the ticker and run until killed due to:
-					// https://github.com/hashicorp/nomad/issues/10058
-					ticker.Stop()
-					logger.Info("running until killed...")
-					continue
+				// Attempt to act on the new scaling opts right away, and keep
+				// attempting until there's nothing left to do, since each
+				// operation only adds or removes a single node.
+				logger.Infof("scaling options updated: primary-count %d, replica-count %d", scaling.PrimaryCount, scaling.ReplicaCount)
+				if !ticking {
+					ticker.Reset(c.attemptInterval)
+					ticking = true
 				}
-				err = attemptLeaderLock(c, scaling, dest)
-				if err != nil {
-					if errors.Is(err, errContinue) {
-						logger.Info(err)
-						continue
-					}
-					logger.Errorf("while attempting to join or create a cluster: %s", err)
+				settle(attemptChanges(c, scaling, thisNode, dest, await, j, lock))
+
+			case <-ticker.C:
+				if scaling == nil {
+					logger.Info("waiting for valid scaling options")
 					continue
 				}
+
+				// Attempt to create or modify a cluster. When reconciling,
+				// this continues for as long as the node runs.
+				settle(attemptChanges(c, scaling, thisNode, dest, await, j, lock))
 			}
 		}
 	}()
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	consul "github.com/letsencrypt/attache/src/consul/client"
+	redisCluster "github.com/letsencrypt/attache/src/redis/cluster"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	logger "github.com/sirupsen/logrus"
+)
+
+var (
+	lockAttempts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "attache_control_lock_attempts_total",
+		Help: "Count of attempts to acquire the leader lock.",
+	})
+	lockAcquisitions = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "attache_control_lock_acquisitions_total",
+		Help: "Count of successful attempts to acquire the leader lock.",
+	})
+	lockHeldSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "attache_control_lock_held_seconds",
+		Help:    "Duration that the leader lock was held for.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 4, 8),
+	})
+	operationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "attache_control_operations_total",
+		Help: "Count of cluster operations applied, by type and result.",
+	}, []string{"type", "result"})
+	operationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "attache_control_operation_duration_seconds",
+		Help:    "Duration of cluster operations, by type.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 4, 8),
+	}, []string{"type"})
+	errorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "attache_control_errors_total",
+		Help: "Count of errors encountered while attempting to modify the cluster, by class.",
+	}, []string{"class"})
+	joinedGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "attache_control_joined",
+		Help: "1 if this node has joined a cluster, otherwise 0.",
+	})
+	observedNodes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "attache_control_observed_nodes",
+		Help: "Count of connected and healthy cluster nodes last observed, by role.",
+	}, []string{"role"})
+	expectedNodes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "attache_control_expected_nodes",
+		Help: "Count of cluster nodes that the scaling options call for, by role.",
+	}, []string{"role"})
+)
+
+// operationType returns the type of the operation made up of `steps` for use
+// as a metric label.
+func operationType(steps []step) string {
+	actions := make(map[action]bool)
+	for _, s := range steps {
+		actions[s.Action] = true
+	}
+	switch {
+	case actions[actionCreate]:
+		return "create"
+	case actions[actionAdopt]:
+		return "replace-primary"
+	case actions[actionMeet] && actions[actionRebalance]:
+		return "add-primary"
+	case actions[actionMeet] && actions[actionReplicate]:
+		return "add-replica"
+	case actions[actionRemove] && len(steps) > 1:
+		return "remove-primary"
+	case actions[actionRemove]:
+		return "remove"
+	case actions[actionRebalance]:
+		return "rebalance"
+	case actions[actionReplicate]:
+		return "move-replica"
+	}
+	return "other"
+}
+
+// errorClass returns the class of `err`, returned while holding the lock, for
+// use as a metric label.
+func errorClass(err error) string {
+	var opErr *redisCluster.OpError
+	switch {
+	case errors.Is(err, errLockLost):
+		return "lock-lost"
+	case errors.Is(err, redisCluster.ErrNotConverged):
+		return "not-converged"
+	case errors.As(err, &opErr):
+		return "redis-command"
+	}
+	return "other"
+}
+
+// recordObservation updates the gauges that compare the cluster described by
+// `obs` with `scaling`.
+func recordObservation(obs observation, scaling *consul.ScalingOpts) {
+	if obs.ThisNodeIsNew {
+		joinedGauge.Set(0)
+	} else {
+		joinedGauge.Set(1)
+	}
+
+	primaries, replicas := countClusterNodes(obs.ClusterNodes)
+	observedNodes.WithLabelValues("primary").Set(float64(primaries))
+	observedNodes.WithLabelValues("replica").Set(float64(replicas))
+	expectedNodes.WithLabelValues("primary").Set(float64(scaling.PrimaryCount))
+	expectedNodes.WithLabelValues("replica").Set(float64(scaling.ReplicaCount))
+}
+
+// serveMetrics serves Prometheus metrics at `addr` under '/metrics'. It should
+// only be called from a long running goroutine.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		logger.Fatalf("serving metrics at %s: %s", addr, err)
+	}
+}
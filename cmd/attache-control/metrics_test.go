@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	redisCluster "github.com/letsencrypt/attache/src/redis/cluster"
+)
+
+func Test_operationType(t *testing.T) {
+	tests := []struct {
+		name    string
+		actions []action
+		want    string
+	}{
+		{"create", []action{actionCreate}, "create"},
+		{"add primary", []action{actionMeet, actionRebalance}, "add-primary"},
+		{"add replica", []action{actionMeet, actionReplicate}, "add-replica"},
+		{"replace failed primary", []action{actionMeet, actionAdopt, actionRemove}, "replace-primary"},
+		{"replace failed replica", []action{actionMeet, actionReplicate, actionRemove}, "add-replica"},
+		{"remove primary", []action{actionRebalance, actionReplicate, actionRemove}, "remove-primary"},
+		{"remove replica", []action{actionRemove}, "remove"},
+		{"rebalance", []action{actionRebalance}, "rebalance"},
+		{"move replica", []action{actionReplicate}, "move-replica"},
+		{"no steps", nil, "other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var steps []step
+			for _, a := range tt.actions {
+				steps = append(steps, step{Action: a})
+			}
+			if got := operationType(steps); got != tt.want {
+				t.Errorf("operationType() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_errorClass(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"lock lost", fmt.Errorf("%w, operation abandoned: %s", errLockLost, "context canceled"), "lock-lost"},
+		{"not converged", fmt.Errorf("while attempting to meet: %w", redisCluster.ErrNotConverged), "not-converged"},
+		{"redis command", fmt.Errorf("while attempting to meet: %w", &redisCluster.OpError{Op: "cluster meet", Node: "10.0.0.1:6379", Err: errors.New("ERR")}), "redis-command"},
+		{"other", errors.New("oops"), "other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorClass(tt.err); got != tt.want {
+				t.Errorf("errorClass() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
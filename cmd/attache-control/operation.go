@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	redis "github.com/letsencrypt/attache/src/redis/client"
+	redisCluster "github.com/letsencrypt/attache/src/redis/cluster"
+	"github.com/letsencrypt/attache/src/redis/config"
+	logger "github.com/sirupsen/logrus"
+)
+
+// maxResumeAttempts is the number of times the lock holder attempts to finish
+// an interrupted operation before abandoning it.
+const maxResumeAttempts = 3
+
+// operationJournal stores the journal of an operation. It's implemented by
+// `*journal.Journal`.
+type operationJournal interface {
+	Load(v interface{}) (bool, error)
+	Save(v interface{}) error
+	Delete() error
+}
+
+// operationRecorder records the step in progress as the operation of the lock
+// holder. It's implemented by `*lockClient.Lock`.
+type operationRecorder interface {
+	SetOperation(operation string) error
+}
+
+// executor performs the steps of an operation against the cluster.
+type executor interface {
+	// rebalanceSlots returns the shard slot ranges that rebalancing the
+	// cluster that `dest` belongs to using `weights` would move.
+	rebalanceSlots(ctx context.Context, dest string, weights map[string]int) ([]redis.SlotRange, error)
+
+	// fixOpenSlots fixes any shard slots left migrating or importing in the
+	// cluster that `node` belongs to and returns the count fixed.
+	fixOpenSlots(ctx context.Context, node string) (int, error)
+
+	// applyStep performs `s` against the cluster.
+	applyStep(ctx context.Context, s step) error
+}
+
+// clusterExecutor is the executor that operates on the Redis Cluster.
+type clusterExecutor struct {
+	conf config.RedisOpts
+	opts redisCluster.Options
+}
+
+func (e clusterExecutor) rebalanceSlots(ctx context.Context, dest string, weights map[string]int) ([]redis.SlotRange, error) {
+	return redisCluster.RebalanceSlots(ctx, e.conf, e.opts, dest, weights)
+}
+
+func (e clusterExecutor) fixOpenSlots(ctx context.Context, node string) (int, error) {
+	return redisCluster.FixOpenSlots(ctx, e.conf, e.opts, node)
+}
+
+func (e clusterExecutor) applyStep(ctx context.Context, s step) error {
+	return s.apply(ctx, e.conf, e.opts)
+}
+
+// operation is the journal of a plan being applied to the cluster. It's stored
+// in Consul KV before each step is attempted and after each step completes so
+// that, if the lock holder dies part way through, the next lock holder can
+// finish the operation before starting new work.
+type operation struct {
+	// ID uniquely identifies the operation in logs.
+	ID string `json:"id"`
+
+	// Steps are the steps of the plan being applied.
+	Steps []step `json:"steps"`
+
+	// Completed is the count of steps that have completed.
+	Completed int `json:"completed"`
+
+	// Slots are the shard slot ranges moved by the step in progress, if any.
+	Slots []redis.SlotRange `json:"slots,omitempty"`
+
+	// Attempts is the count of times a lock holder has attempted to finish the
+	// operation after it was interrupted.
+	Attempts int `json:"attempts,omitempty"`
+}
+
+// newOperation returns a new operation, with a random ID, for applying `p`.
+func newOperation(p plan) (*operation, error) {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+	return &operation{ID: hex.EncodeToString(id), Steps: p.Steps}, nil
+}
+
+// clusterNode returns the address of a node that belonged to, or was used to
+// create, the cluster being operated on.
+func (op *operation) clusterNode() string {
+	for _, s := range op.Steps {
+		if s.Dest != "" {
+			return s.Dest
+		}
+		if len(s.Nodes) > 0 {
+			return s.Nodes[0]
+		}
+	}
+	return ""
+}
+
+// apply performs each remaining step of the operation, in order, against the
+// cluster and records its progress in `j`. The journal is deleted once every
+// step has completed. Each step is also recorded as the operation of the holder
+// of `lock` so that operators can tell what it's doing. If a step fails the
+// remaining steps are not attempted and the journal is left in place, as it is
+// if `ctx` is cancelled.
+func (op *operation) apply(ctx context.Context, e executor, j operationJournal, lock operationRecorder) (err error) {
+	opType := operationType(op.Steps)
+	start := time.Now()
+	defer func() {
+		result := "success"
+		if err != nil {
+			result = "failure"
+		}
+		operationsTotal.WithLabelValues(opType, result).Inc()
+		operationSeconds.WithLabelValues(opType).Observe(time.Since(start).Seconds())
+	}()
+
+	for op.Completed < len(op.Steps) {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		s := op.Steps[op.Completed]
+		log := logger.WithFields(logger.Fields{"operation": op.ID, "step": op.Completed + 1, "steps": len(op.Steps), "action": s.Action})
+
+		op.Slots = nil
+		if s.Action == actionRebalance {
+			var err error
+			op.Slots, err = e.rebalanceSlots(ctx, s.Dest, s.Weights)
+			if err != nil {
+				return fmt.Errorf("while attempting to %s: %w", s.Description, err)
+			}
+		}
+
+		err := j.Save(op)
+		if err != nil {
+			return err
+		}
+
+		err = lock.SetOperation(fmt.Sprintf("operation %s, step %d of %d: %s", op.ID, op.Completed+1, len(op.Steps), s.Description))
+		if err != nil {
+			log.Warn(err)
+		}
+
+		log.Infof("attempting to %s", s.Description)
+		err = e.applyStep(ctx, s)
+		if err != nil {
+			return fmt.Errorf("while attempting to %s: %w", s.Description, err)
+		}
+		log.Info("step succeeded")
+
+		op.Completed++
+		op.Slots = nil
+		err = j.Save(op)
+		if err != nil {
+			return err
+		}
+	}
+	return j.Delete()
+}
+
+// resumeOperation loads the journal of an operation that was interrupted, if
+// one exists, fixes any shard slots it left migrating or importing, then
+// attempts its remaining steps. If the operation still can't be finished after
+// maxResumeAttempts it's abandoned, which leaves the cluster in a stable state
+// from which a new plan can be made.
+func resumeOperation(ctx context.Context, e executor, j operationJournal, lock operationRecorder) error {
+	var op operation
+	found, err := j.Load(&op)
+	if err != nil || !found {
+		return err
+	}
+
+	op.Attempts++
+	log := logger.WithFields(logger.Fields{"operation": op.ID, "attempt": op.Attempts})
+	log.Warnf("resuming an interrupted operation after %d of %d steps, moving slots %v", op.Completed, len(op.Steps), op.Slots)
+
+	err = j.Save(&op)
+	if err != nil {
+		return err
+	}
+
+	err = func() error {
+		clusterNode := op.clusterNode()
+		if clusterNode != "" {
+			fixed, err := e.fixOpenSlots(ctx, clusterNode)
+			if err != nil {
+				return err
+			}
+			if fixed > 0 {
+				log.Infof("fixed %d open shard slots", fixed)
+			}
+		}
+		return op.apply(ctx, e, j, lock)
+	}()
+	if err == nil {
+		log.Info("finished the interrupted operation")
+		return nil
+	}
+
+	if op.Attempts < maxResumeAttempts || ctx.Err() != nil {
+		return fmt.Errorf("couldn't finish interrupted operation %s: %w", op.ID, err)
+	}
+	log.Errorf("abandoning the interrupted operation after %d attempts: %s", op.Attempts, err)
+	return j.Delete()
+}
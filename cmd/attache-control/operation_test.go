@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	redis "github.com/letsencrypt/attache/src/redis/client"
+)
+
+// memoryJournal is an operationJournal that stores the journal in memory.
+type memoryJournal struct {
+	value []byte
+}
+
+func (j *memoryJournal) Load(v interface{}) (bool, error) {
+	if j.value == nil {
+		return false, nil
+	}
+	return true, json.Unmarshal(j.value, v)
+}
+
+func (j *memoryJournal) Save(v interface{}) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	j.value = value
+	return nil
+}
+
+func (j *memoryJournal) Delete() error {
+	j.value = nil
+	return nil
+}
+
+type nopRecorder struct{}
+
+func (nopRecorder) SetOperation(string) error { return nil }
+
+// fakeExecutor is an executor that records the nodes it fixes open slots in
+// and applies steps to, failing any step for the node `failNode`.
+type fakeExecutor struct {
+	failNode string
+	fixed    []string
+	applied  []string
+}
+
+func (e *fakeExecutor) rebalanceSlots(context.Context, string, map[string]int) ([]redis.SlotRange, error) {
+	return nil, nil
+}
+
+func (e *fakeExecutor) fixOpenSlots(_ context.Context, node string) (int, error) {
+	e.fixed = append(e.fixed, node)
+	return 0, nil
+}
+
+func (e *fakeExecutor) applyStep(ctx context.Context, s step) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if s.Node == e.failNode {
+		return errors.New("step failed")
+	}
+	e.applied = append(e.applied, s.Node)
+	return nil
+}
+
+func Test_resumeOperation(t *testing.T) {
+	steps := []step{
+		{Action: actionMeet, Node: "10.0.0.4:6379", Dest: "10.0.0.1:6379"},
+		{Action: actionMeet, Node: "10.0.0.5:6379", Dest: "10.0.0.1:6379"},
+		{Action: actionMeet, Node: "10.0.0.6:6379", Dest: "10.0.0.1:6379"},
+	}
+	tests := []struct {
+		name        string
+		journal     *operation
+		failNode    string
+		cancelled   bool
+		wantErr     bool
+		wantFixed   []string
+		wantApplied []string
+		wantJournal *operation
+	}{
+		{
+			name: "no interrupted operation",
+		},
+		{
+			name:        "resume",
+			journal:     &operation{ID: "op", Steps: steps, Completed: 1},
+			wantFixed:   []string{"10.0.0.1:6379"},
+			wantApplied: []string{"10.0.0.5:6379", "10.0.0.6:6379"},
+		},
+		{
+			name:        "step completes before the next fails",
+			journal:     &operation{ID: "op", Steps: steps, Completed: 1},
+			failNode:    "10.0.0.6:6379",
+			wantErr:     true,
+			wantFixed:   []string{"10.0.0.1:6379"},
+			wantApplied: []string{"10.0.0.5:6379"},
+			wantJournal: &operation{ID: "op", Steps: steps, Completed: 2, Attempts: 1},
+		},
+		{
+			name:        "abandoned after the last attempt fails",
+			journal:     &operation{ID: "op", Steps: steps, Completed: 1, Attempts: maxResumeAttempts - 1},
+			failNode:    "10.0.0.5:6379",
+			wantFixed:   []string{"10.0.0.1:6379"},
+			wantApplied: nil,
+		},
+		{
+			name:        "not abandoned when the lock is lost",
+			journal:     &operation{ID: "op", Steps: steps, Completed: 1, Attempts: maxResumeAttempts - 1},
+			cancelled:   true,
+			wantErr:     true,
+			wantFixed:   []string{"10.0.0.1:6379"},
+			wantJournal: &operation{ID: "op", Steps: steps, Completed: 1, Attempts: maxResumeAttempts},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancelled {
+				cancel()
+			}
+
+			j := &memoryJournal{}
+			if tt.journal != nil {
+				err := j.Save(tt.journal)
+				if err != nil {
+					t.Fatalf("Save() error = %v", err)
+				}
+			}
+			e := &fakeExecutor{failNode: tt.failNode}
+
+			err := resumeOperation(ctx, e, j, nopRecorder{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resumeOperation() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(e.fixed, tt.wantFixed) {
+				t.Errorf("resumeOperation() fixed open slots in %v, want %v", e.fixed, tt.wantFixed)
+			}
+			if !reflect.DeepEqual(e.applied, tt.wantApplied) {
+				t.Errorf("resumeOperation() applied steps for %v, want %v", e.applied, tt.wantApplied)
+			}
+
+			var got *operation
+			var op operation
+			found, err := j.Load(&op)
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			if found {
+				got = &op
+			}
+			if !reflect.DeepEqual(got, tt.wantJournal) {
+				t.Errorf("resumeOperation() left journal %+v, want %+v", got, tt.wantJournal)
+			}
+		})
+	}
+}
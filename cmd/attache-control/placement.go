@@ -0,0 +1,148 @@
+package main
+
+import (
+	"sort"
+
+	redis "github.com/letsencrypt/attache/src/redis/client"
+)
+
+// primaryForReplica selects the shard primary in `nodes` that the replica at
+// `replicaAddr` should replicate, as redis.PrimaryForReplica does, but prefers
+// primaries whose shard has no other member in the same failure domain as the
+// replica. When every shard has a member in that failure domain, or the replica
+// has no failure domain, failure domains are ignored.
+func primaryForReplica(nodes []redis.ClusterNode, domains map[string]string, replicaAddr string, excludeID string) (redis.ClusterNode, error) {
+	domain := domains[replicaAddr]
+	if domain == "" {
+		return redis.PrimaryForReplica(nodes, excludeID)
+	}
+
+	// Find every shard primary with a member in the same failure domain as
+	// the replica. Failed nodes are ignored since they're going to be
+	// forgotten.
+	sharesDomain := make(map[string]bool)
+	for _, n := range nodes {
+		if n.Addr == replicaAddr || n.HasFailed() || domains[n.Addr] != domain {
+			continue
+		}
+		if n.IsPrimary() {
+			sharesDomain[n.ID] = true
+		} else if n.IsReplica() && n.PrimaryID != "" {
+			sharesDomain[n.PrimaryID] = true
+		}
+	}
+
+	var candidates []redis.ClusterNode
+	for _, n := range nodes {
+		if !sharesDomain[n.ID] {
+			candidates = append(candidates, n)
+		}
+	}
+	primary, err := redis.PrimaryForReplica(candidates, excludeID)
+	if err != nil {
+		return redis.PrimaryForReplica(nodes, excludeID)
+	}
+	return primary, nil
+}
+
+// orderByFailureDomain orders `nodes` for redisCluster.CreateCluster, which
+// makes the first `primaryCount` nodes shard primaries and attaches the
+// remaining node at index i to the primary at index i % primaryCount. Shard
+// primaries are spread across failure domains and each replica is placed, where
+// possible, in a failure domain that no other member of its shard is in. Nodes
+// without a failure domain can be placed in any shard. `nodes` is returned
+// unchanged if none of them has a failure domain.
+func orderByFailureDomain(nodes []string, domains map[string]string, primaryCount int) []string {
+	byDomain := make(map[string][]string)
+	var names []string
+	for _, n := range nodes {
+		d := domains[n]
+		if _, ok := byDomain[d]; !ok {
+			names = append(names, d)
+		}
+		byDomain[d] = append(byDomain[d], n)
+	}
+	if len(byDomain[""]) == len(nodes) || primaryCount <= 0 || primaryCount > len(nodes) {
+		return nodes
+	}
+	sort.Strings(names)
+
+	// take removes and returns the next node of a failure domain that isn't in
+	// `avoid`, or of any failure domain if every failure domain with remaining
+	// nodes is in `avoid`. The failure domain with the most remaining nodes is
+	// preferred, then the one that's avoided by the most shards in `pending`,
+	// since those shards won't be able to use it. Remaining ties are broken by
+	// the name of the failure domain.
+	take := func(avoid map[string]bool, pending []map[string]bool) string {
+		pick := func(skipAvoided bool) (string, bool) {
+			var candidates []string
+			for _, d := range names {
+				if len(byDomain[d]) > 0 && !(skipAvoided && avoid[d]) {
+					candidates = append(candidates, d)
+				}
+			}
+			avoidedBy := func(d string) int {
+				var count int
+				for _, shard := range pending {
+					if shard[d] {
+						count++
+					}
+				}
+				return count
+			}
+			sort.SliceStable(candidates, func(i, j int) bool {
+				a, b := candidates[i], candidates[j]
+				if len(byDomain[a]) != len(byDomain[b]) {
+					return len(byDomain[a]) > len(byDomain[b])
+				}
+				return avoidedBy(a) > avoidedBy(b)
+			})
+			if len(candidates) == 0 {
+				return "", false
+			}
+			return candidates[0], true
+		}
+		d, ok := pick(true)
+		if !ok {
+			d, _ = pick(false)
+		}
+		n := byDomain[d][0]
+		byDomain[d] = byDomain[d][1:]
+		return n
+	}
+
+	ordered := make([]string, 0, len(nodes))
+	primaryDomains := make(map[string]bool)
+	shardDomains := make([]map[string]bool, primaryCount)
+	for i := range shardDomains {
+		n := take(primaryDomains, nil)
+		ordered = append(ordered, n)
+		shardDomains[i] = make(map[string]bool)
+		if d := domains[n]; d != "" {
+			primaryDomains[d] = true
+			shardDomains[i][d] = true
+		}
+	}
+
+	// Replicas are placed a round at a time, each round attaching at most one
+	// replica to each shard primary in order.
+	for len(ordered) < len(nodes) {
+		round := minInt(primaryCount, len(nodes)-len(ordered))
+		for i := 0; i < round; i++ {
+			n := take(shardDomains[i], shardDomains[i+1:round])
+			ordered = append(ordered, n)
+			if d := domains[n]; d != "" {
+				shardDomains[i][d] = true
+			}
+		}
+	}
+	return ordered
+}
+
+// minInt returns the smaller of `a` and `b`.
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
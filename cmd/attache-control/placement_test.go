@@ -0,0 +1,119 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	redis "github.com/letsencrypt/attache/src/redis/client"
+)
+
+func Test_primaryForReplica(t *testing.T) {
+	// 'a' and its replica 'd' are in rack r1, 'b' is in rack r2 and 'c' is in
+	// rack r3.
+	domains := map[string]string{
+		"10.0.0.1:6379": "r1",
+		"10.0.0.2:6379": "r2",
+		"10.0.0.3:6379": "r3",
+		"10.0.0.4:6379": "r1",
+	}
+
+	tests := []struct {
+		name        string
+		nodes       []redis.ClusterNode
+		domains     map[string]string
+		replicaAddr string
+		want        string
+	}{
+		{"no failure domains", threeShards, nil, "10.0.0.5:6379", "b"},
+		{"replica without a failure domain", threeShards, domains, "10.0.0.5:6379", "b"},
+		{"replica in the failure domain of an orphaned primary", threeShards, map[string]string{"10.0.0.2:6379": "r2", "10.0.0.5:6379": "r2"}, "10.0.0.5:6379", "c"},
+		{
+			// Every primary has one replica, so 'a' would be selected if
+			// failure domains were ignored, but its replica 'd' is in r1.
+			"replica in the failure domain of a replica",
+			append(threeShards, replicaNode("e", "10.0.0.6:6379", "b"), replicaNode("f", "10.0.0.7:6379", "c")),
+			map[string]string{"10.0.0.1:6379": "r2", "10.0.0.2:6379": "r3", "10.0.0.4:6379": "r1", "10.0.0.5:6379": "r1"},
+			"10.0.0.5:6379",
+			"b",
+		},
+		{
+			// Every shard has a member in r1, so failure domains are ignored.
+			"every shard shares the failure domain",
+			threeShards,
+			map[string]string{"10.0.0.1:6379": "r1", "10.0.0.2:6379": "r1", "10.0.0.3:6379": "r1", "10.0.0.5:6379": "r1"},
+			"10.0.0.5:6379",
+			"b",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := primaryForReplica(tt.nodes, tt.domains, tt.replicaAddr, "")
+			if err != nil {
+				t.Fatalf("primaryForReplica() error = %v", err)
+			}
+			if got.ID != tt.want {
+				t.Errorf("primaryForReplica() = %s, want %s", got.ID, tt.want)
+			}
+		})
+	}
+}
+
+func Test_orderByFailureDomain(t *testing.T) {
+	tests := []struct {
+		name         string
+		nodes        []string
+		domains      map[string]string
+		primaryCount int
+		want         []string
+	}{
+		{
+			"no failure domains",
+			[]string{"n1", "n2", "n3", "n4", "n5", "n6"},
+			nil,
+			3,
+			[]string{"n1", "n2", "n3", "n4", "n5", "n6"},
+		},
+		{
+			// Consul returns the nodes grouped by rack, which would otherwise
+			// place every member of the first shard in r1.
+			"one replica per primary",
+			[]string{"n1", "n2", "n3", "n4", "n5", "n6"},
+			map[string]string{"n1": "r1", "n2": "r1", "n3": "r2", "n4": "r2", "n5": "r3", "n6": "r3"},
+			3,
+			[]string{"n1", "n3", "n5", "n4", "n6", "n2"},
+		},
+		{
+			"two replicas per primary",
+			[]string{"n1", "n2", "n3", "n4", "n5", "n6", "n7", "n8", "n9"},
+			map[string]string{"n1": "r1", "n2": "r1", "n3": "r1", "n4": "r2", "n5": "r2", "n6": "r2", "n7": "r3", "n8": "r3", "n9": "r3"},
+			3,
+			[]string{"n1", "n4", "n7", "n5", "n8", "n2", "n9", "n3", "n6"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := orderByFailureDomain(tt.nodes, tt.domains, tt.primaryCount)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("orderByFailureDomain() = %v, want %v", got, tt.want)
+			}
+			if tt.domains == nil {
+				return
+			}
+
+			// No shard may have all of its members in one failure domain.
+			shards := make([]map[string]bool, tt.primaryCount)
+			for i, n := range got {
+				shard := i % tt.primaryCount
+				if shards[shard] == nil {
+					shards[shard] = make(map[string]bool)
+				}
+				shards[shard][tt.domains[n]] = true
+			}
+			for i, domains := range shards {
+				if len(domains) < 2 {
+					t.Errorf("shard %d has every member in one failure domain", i)
+				}
+			}
+		})
+	}
+}
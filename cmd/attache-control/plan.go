@@ -0,0 +1,570 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	consul "github.com/letsencrypt/attache/src/consul/client"
+	redis "github.com/letsencrypt/attache/src/redis/client"
+	redisCluster "github.com/letsencrypt/attache/src/redis/cluster"
+	"github.com/letsencrypt/attache/src/redis/config"
+)
+
+// action is the kind of cluster operation performed by a step.
+type action string
+
+const (
+	// actionCreate creates a new cluster from `step.Nodes`.
+	actionCreate action = "create"
+
+	// actionMeet introduces `step.Node` to the cluster that `step.Dest`
+	// belongs to.
+	actionMeet action = "meet"
+
+	// actionRebalance rebalances the shard slots of the cluster that
+	// `step.Dest` belongs to using `step.Weights`.
+	actionRebalance action = "rebalance"
+
+	// actionReplicate attaches `step.Node` to the shard primary with ID
+	// `step.PrimaryID` as a replica.
+	actionReplicate action = "replicate"
+
+	// actionRemove resets `step.Node` and forgets the node with ID
+	// `step.NodeID` on every other node in the cluster that `step.Dest`
+	// belongs to.
+	actionRemove action = "remove"
+
+	// actionAdopt assigns the shard slots of the failed shard primary with ID
+	// `step.NodeID` to `step.Node` in the cluster that `step.Dest` belongs to.
+	actionAdopt action = "adopt"
+)
+
+// step is a single cluster operation in a plan.
+type step struct {
+	Action             action         `json:"action"`
+	Description        string         `json:"description"`
+	Node               string         `json:"node,omitempty"`
+	NodeID             string         `json:"node-id,omitempty"`
+	Nodes              []string       `json:"nodes,omitempty"`
+	Dest               string         `json:"dest,omitempty"`
+	PrimaryID          string         `json:"primary-id,omitempty"`
+	ReplicasPerPrimary int            `json:"replicas-per-primary,omitempty"`
+	Weights            map[string]int `json:"weights,omitempty"`
+}
+
+// plan is an ordered list of steps that bring the cluster closer to the state
+// described by the scaling opts.
+type plan struct {
+	Steps []step `json:"steps"`
+}
+
+// observation is the state of this node, the Consul services, and the cluster
+// that a plan is made from.
+type observation struct {
+	// ThisNode is the address of the node this serves as a sidecar to.
+	ThisNode string
+
+	// ThisNodeIsNew is true if this node has never joined a cluster.
+	ThisNodeIsNew bool
+
+	// NodesInAwait are the healthy nodes in the await Consul service. They're
+	// only gathered when no cluster exists yet.
+	NodesInAwait []string
+
+	// NodesInDest are the healthy nodes in the destination Consul service.
+	NodesInDest []string
+
+	// ClusterNodes are the nodes of the existing cluster, if any, as seen by
+	// this node or the first node in NodesInDest.
+	ClusterNodes []redis.ClusterNode
+
+	// FailureDomains maps the address of each node in the Consul services to
+	// its failure domain. Nodes without a failure domain are omitted.
+	FailureDomains map[string]string
+}
+
+// countClusterNodes returns the count of shard primaries and replicas in
+// `nodes` that are connected and healthy.
+func countClusterNodes(nodes []redis.ClusterNode) (int, int) {
+	var primaries, replicas int
+	for _, n := range nodes {
+		if !n.IsConnected() || n.IsFailing() {
+			continue
+		}
+		if n.IsPrimary() {
+			primaries++
+		} else if n.IsReplica() {
+			replicas++
+		}
+	}
+	return primaries, replicas
+}
+
+// makePlan returns the plan required to bring the cluster described by `obs`
+// closer to the state described by `scaling`. When `reconcile` is true and this
+// node has joined the cluster, drift in the cluster is also repaired. An empty
+// plan is returned when there's nothing to do. An error wrapping errContinue is
+// returned when the plan can't be made yet.
+func makePlan(obs observation, scaling *consul.ScalingOpts, reconcile bool) (plan, error) {
+	if obs.ThisNodeIsNew {
+		return planJoinOrCreate(obs, scaling)
+	}
+
+	p, err := planScaleIn(obs, scaling)
+	if err != nil || len(p.Steps) > 0 || !reconcile {
+		return p, err
+	}
+	return planReconcile(obs, scaling)
+}
+
+// planJoinOrCreate returns a plan that introduces this node to an existing
+// cluster or, if none exists, creates a new cluster from the nodes in the await
+// Consul service.
+func planJoinOrCreate(obs observation, scaling *consul.ScalingOpts) (plan, error) {
+	// If no existing nodes can be found in the destination Consul service, we
+	// know that we need to initialize a new cluster.
+	if len(obs.NodesInDest) == 0 {
+		// We should only attempt to initialize a new cluster if all of the
+		// nodes that we expect in said cluster have finished starting up and
+		// reside in the awaitService Consul service.
+		primaryCount := len(obs.NodesInAwait) / (scaling.ReplicasPerPrimary() + 1)
+		if scaling.ReplicasPerPrimary() == 0 {
+			primaryCount = scaling.PrimaryCount
+		}
+
+		if scaling.NodesMissing(len(obs.NodesInAwait)) >= 1 {
+			if scaling.MinPrimariesToBootstrap == 0 || len(obs.NodesInAwait) < scaling.MinPrimariesToBootstrap {
+				return plan{}, fmt.Errorf("still waiting for nodes to startup: %w", errContinue)
+			}
+
+			// Enough nodes are waiting to bootstrap a cluster of shard
+			// primaries. The remaining nodes will add themselves to it, as
+			// primaries or replicas, once they've started.
+			primaryCount = minInt(len(obs.NodesInAwait), scaling.PrimaryCount)
+			nodesToCluster := orderByFailureDomain(obs.NodesInAwait, obs.FailureDomains, primaryCount)[:primaryCount]
+			return plan{[]step{{
+				Action:      actionCreate,
+				Description: fmt.Sprintf("bootstrap a new cluster from %d of %d expected shard primaries", len(nodesToCluster), scaling.PrimaryCount),
+				Nodes:       nodesToCluster,
+			}}}, nil
+		}
+
+		// Order the nodes so that no shard has all of its members in one
+		// failure domain.
+		nodesToCluster := orderByFailureDomain(obs.NodesInAwait, obs.FailureDomains, primaryCount)
+		if scaling.ReplicasPerPrimary() == 0 {
+			// With a replica-count of 0 every node in the cluster is made a
+			// shard primary, so any nodes waiting beyond primary-count, such
+			// as those started by a Nomad group count that was raised ahead of
+			// the scaling opts, are left out of the new cluster rather than
+			// made extra primaries.
+			nodesToCluster = nodesToCluster[:primaryCount]
+		}
+		return plan{[]step{{
+			Action:             actionCreate,
+			Description:        fmt.Sprintf("create a new cluster from %d nodes", len(nodesToCluster)),
+			Nodes:              nodesToCluster,
+			ReplicasPerPrimary: scaling.ReplicasPerPrimary(),
+		}}}, nil
+	}
+
+	dest := obs.NodesInDest[0]
+	meet := step{
+		Action:      actionMeet,
+		Description: fmt.Sprintf("introduce %s to the cluster that %s belongs to", obs.ThisNode, dest),
+		Node:        obs.ThisNode,
+		Dest:        dest,
+	}
+
+	replacement, err := planReplacement(obs, meet)
+	if err != nil || len(replacement.Steps) > 0 {
+		return replacement, err
+	}
+
+	primaries, replicas := countClusterNodes(obs.ClusterNodes)
+	if primaries < scaling.PrimaryCount {
+		// The current cluster has less than the expected shard primary nodes.
+		// This node should be added as a new primary and the existing cluster
+		// shard slots should be rebalanced.
+		return plan{[]step{
+			meet,
+			{
+				Action:      actionRebalance,
+				Description: fmt.Sprintf("rebalance shard slots onto new shard primary %s", obs.ThisNode),
+				Dest:        dest,
+			},
+		}}, nil
+
+	} else if replicas < scaling.ReplicaCount {
+		// All expected shard primary nodes exist in the current cluster. This
+		// node should be added as a replica to the primary node with the least
+		// number of replicas, outside of this node's failure domain.
+		primary, err := primaryForReplica(obs.ClusterNodes, obs.FailureDomains, obs.ThisNode, "")
+		if err != nil {
+			return plan{}, err
+		}
+		return plan{[]step{
+			meet,
+			{
+				Action:      actionReplicate,
+				Description: fmt.Sprintf("attach %s to shard primary %s as a replica", obs.ThisNode, primary.Addr),
+				Node:        obs.ThisNode,
+				PrimaryID:   primary.ID,
+			},
+		}}, nil
+	}
+
+	if scaling.NodesMissing(primaries+replicas) == 0 {
+		// This will only happen when the Nomad job is scaled without a
+		// corresponding change to the scaling opts in Consul.
+		return plan{}, fmt.Errorf("%s Nomad group count was scaled without a corresponding change to scaling opts", obs.ThisNode)
+	}
+
+	// This should never happen.
+	return plan{}, fmt.Errorf("%s couldn't be added to an existing cluster", obs.ThisNode)
+}
+
+// planReplacement returns a plan that has this node take the place of a node
+// that the cluster has marked as failed or that has no known address. A failed
+// shard primary that still serves shard slots, because no replica took over for
+// it, is replaced first; this node adopts its slots. Otherwise this node is
+// attached as a replica to the shard primary with the fewest healthy replicas,
+// such as one orphaned by the failure. The failed node is then forgotten by
+// every node in the cluster. An empty plan is returned if no node has failed.
+func planReplacement(obs observation, meet step) (plan, error) {
+	var failed []redis.ClusterNode
+	for _, n := range obs.ClusterNodes {
+		if n.HasFailed() {
+			failed = append(failed, n)
+		}
+	}
+	if len(failed) == 0 {
+		return plan{}, nil
+	}
+	sort.Slice(failed, func(i, j int) bool {
+		return failed[i].ID < failed[j].ID
+	})
+
+	forget := func(n redis.ClusterNode) step {
+		return step{
+			Action:      actionRemove,
+			Description: fmt.Sprintf("forget failed node %s", n.Addr),
+			Node:        n.Addr,
+			NodeID:      n.ID,
+			Dest:        meet.Dest,
+		}
+	}
+
+	for _, n := range failed {
+		if n.IsPrimary() && n.SlotCount() > 0 {
+			return plan{[]step{
+				meet,
+				{
+					Action:      actionAdopt,
+					Description: fmt.Sprintf("adopt %d shard slots from failed shard primary %s", n.SlotCount(), n.Addr),
+					Node:        obs.ThisNode,
+					NodeID:      n.ID,
+					Dest:        meet.Dest,
+				},
+				forget(n),
+			}}, nil
+		}
+	}
+
+	primary, err := primaryForReplica(obs.ClusterNodes, obs.FailureDomains, obs.ThisNode, "")
+	if err != nil {
+		return plan{}, err
+	}
+
+	// Prefer to take the place of a failed replica of the chosen primary.
+	replaced := failed[0]
+	for _, n := range failed {
+		if n.PrimaryID == primary.ID {
+			replaced = n
+			break
+		}
+	}
+	return plan{[]step{
+		meet,
+		{
+			Action:      actionReplicate,
+			Description: fmt.Sprintf("attach %s to shard primary %s as a replica, replacing failed node %s", obs.ThisNode, primary.Addr, replaced.Addr),
+			Node:        obs.ThisNode,
+			PrimaryID:   primary.ID,
+		},
+		forget(replaced),
+	}}, nil
+}
+
+// planScaleIn returns a plan that removes a single shard primary or replica
+// from the cluster this node belongs to if the cluster has more shard primaries
+// or replicas than the scaling opts call for. Primaries are removed before
+// replicas.
+func planScaleIn(obs observation, scaling *consul.ScalingOpts) (plan, error) {
+	primaries, _ := countClusterNodes(obs.ClusterNodes)
+
+	// Every replica is counted, including those that are failing, since they
+	// must still be forgotten.
+	var replicas int
+	for _, n := range obs.ClusterNodes {
+		if n.IsReplica() {
+			replicas++
+		}
+	}
+
+	if primaries > scaling.PrimaryCount {
+		primary, err := redis.PrimaryToRemove(obs.ClusterNodes)
+		if err != nil {
+			return plan{}, err
+		}
+		dest, err := destExcluding(obs, primary.ID)
+		if err != nil {
+			return plan{}, err
+		}
+
+		var steps []step
+		if primary.SlotCount() > 0 {
+			// Setting the weight of the primary to 0 causes the rebalance to
+			// migrate all of its shard slots to the remaining primaries.
+			steps = append(steps, step{
+				Action:      actionRebalance,
+				Description: fmt.Sprintf("drain %d shard slots from shard primary %s", primary.SlotCount(), primary.Addr),
+				Dest:        dest,
+				Weights:     map[string]int{primary.ID: 0},
+			})
+		}
+
+		// Plan replica moves against a copy of the cluster nodes so that each
+		// replica is placed using the updated replica counts.
+		nodes := append([]redis.ClusterNode(nil), obs.ClusterNodes...)
+		for _, replica := range redis.ReplicasOf(nodes, primary.ID) {
+			newPrimary, err := primaryForReplica(nodes, obs.FailureDomains, replica.Addr, primary.ID)
+			if err != nil {
+				return plan{}, err
+			}
+			steps = append(steps, step{
+				Action:      actionReplicate,
+				Description: fmt.Sprintf("move replica %s to shard primary %s", replica.Addr, newPrimary.Addr),
+				Node:        replica.Addr,
+				PrimaryID:   newPrimary.ID,
+			})
+			for i := range nodes {
+				if nodes[i].ID == replica.ID {
+					nodes[i].PrimaryID = newPrimary.ID
+				}
+			}
+		}
+
+		steps = append(steps, step{
+			Action:      actionRemove,
+			Description: fmt.Sprintf("remove shard primary %s, cluster has %d but %d are expected", primary.Addr, primaries, scaling.PrimaryCount),
+			Node:        primary.Addr,
+			NodeID:      primary.ID,
+			Dest:        dest,
+		})
+		return plan{steps}, nil
+
+	} else if replicas > scaling.ReplicaCount {
+		replica, err := redis.ReplicaToRemove(obs.ClusterNodes)
+		if err != nil {
+			return plan{}, err
+		}
+		dest, err := destExcluding(obs, replica.ID)
+		if err != nil {
+			return plan{}, err
+		}
+		return plan{[]step{{
+			Action:      actionRemove,
+			Description: fmt.Sprintf("remove shard replica %s, cluster has %d but %d are expected", replica.Addr, replicas, scaling.ReplicaCount),
+			Node:        replica.Addr,
+			NodeID:      replica.ID,
+			Dest:        dest,
+		}}}, nil
+	}
+	return plan{}, nil
+}
+
+// destExcluding returns the address of the node that steps removing the node
+// with ID `excludeID` from the cluster should be performed against: this node,
+// unless it's the one being removed, otherwise the connected shard primary with
+// the lowest ID. The node being removed is reset part way through its removal,
+// after which it knows no other node and can't be used to resume the
+// operation.
+func destExcluding(obs observation, excludeID string) (string, error) {
+	var candidates []redis.ClusterNode
+	for _, n := range obs.ClusterNodes {
+		if n.ID == excludeID || !n.IsConnected() || n.IsFailing() {
+			continue
+		}
+		if n.Addr == obs.ThisNode {
+			return n.Addr, nil
+		}
+		if n.IsPrimary() {
+			candidates = append(candidates, n)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("no connected shard primary, other than node %s, to perform its removal against", excludeID)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].ID < candidates[j].ID
+	})
+	return candidates[0].Addr, nil
+}
+
+// planReconcile returns a plan that repairs drift in the cluster this node
+// belongs to which new nodes won't repair by joining. In order of priority: a
+// failed shard primary that still serves shard slots has them adopted by an
+// empty shard primary, an empty shard primary is given shard slots, a replica
+// is moved from the shard primary with the most healthy replicas to the one
+// with the fewest (such as an orphaned primary), and failed nodes that the
+// cluster no longer needs are forgotten. Only one repair is planned at a time.
+// An empty plan is returned if no drift is found.
+func planReconcile(obs observation, scaling *consul.ScalingOpts) (plan, error) {
+	healthy := func(n redis.ClusterNode) bool {
+		return n.IsConnected() && !n.IsFailing()
+	}
+
+	var empty, failed, serving []redis.ClusterNode
+	replicasOf := make(map[string][]redis.ClusterNode)
+	for _, n := range obs.ClusterNodes {
+		switch {
+		case n.HasFailed():
+			failed = append(failed, n)
+		case n.IsPrimary() && healthy(n) && n.SlotCount() == 0:
+			empty = append(empty, n)
+		case n.IsPrimary() && healthy(n):
+			serving = append(serving, n)
+		case n.IsReplica() && healthy(n):
+			replicasOf[n.PrimaryID] = append(replicasOf[n.PrimaryID], n)
+		}
+	}
+	for _, nodes := range [][]redis.ClusterNode{empty, failed, serving} {
+		sort.Slice(nodes, func(i, j int) bool {
+			return nodes[i].ID < nodes[j].ID
+		})
+	}
+
+	forget := func(n redis.ClusterNode, dest string, reason string) step {
+		return step{
+			Action:      actionRemove,
+			Description: fmt.Sprintf("forget failed node %s, %s", n.Addr, reason),
+			Node:        n.Addr,
+			NodeID:      n.ID,
+			Dest:        dest,
+		}
+	}
+
+	for _, n := range failed {
+		if n.IsPrimary() && n.SlotCount() > 0 && len(empty) > 0 {
+			dest, err := destExcluding(obs, n.ID)
+			if err != nil {
+				return plan{}, err
+			}
+			return plan{[]step{
+				{
+					Action:      actionAdopt,
+					Description: fmt.Sprintf("adopt %d shard slots from failed shard primary %s onto empty shard primary %s", n.SlotCount(), n.Addr, empty[0].Addr),
+					Node:        empty[0].Addr,
+					NodeID:      n.ID,
+					Dest:        dest,
+				},
+				forget(n, dest, "its shard slots were adopted"),
+			}}, nil
+		}
+	}
+
+	if len(empty) > 0 {
+		// The primary was introduced to the cluster but the rebalance that
+		// should have followed never completed.
+		return plan{[]step{{
+			Action:      actionRebalance,
+			Description: fmt.Sprintf("rebalance shard slots onto empty shard primary %s", empty[0].Addr),
+			Dest:        obs.ThisNode,
+		}}}, nil
+	}
+
+	var donor redis.ClusterNode
+	for _, n := range serving {
+		if len(replicasOf[n.ID]) > len(replicasOf[donor.ID]) {
+			donor = n
+		}
+	}
+	if len(replicasOf[donor.ID]) >= 2 {
+		replicas := replicasOf[donor.ID]
+		sort.Slice(replicas, func(i, j int) bool {
+			return replicas[i].ID < replicas[j].ID
+		})
+		replica := replicas[0]
+		target, err := primaryForReplica(obs.ClusterNodes, obs.FailureDomains, replica.Addr, donor.ID)
+		if err != nil {
+			return plan{}, err
+		}
+
+		// Only move the replica if doing so narrows the gap between the
+		// primaries with the most and the fewest replicas.
+		if len(replicasOf[target.ID])+2 <= len(replicas) {
+			return plan{[]step{{
+				Action:      actionReplicate,
+				Description: fmt.Sprintf("move replica %s from shard primary %s, with %d replicas, to shard primary %s, with %d", replica.Addr, donor.Addr, len(replicas), target.Addr, len(replicasOf[target.ID])),
+				Node:        replica.Addr,
+				PrimaryID:   target.ID,
+			}}}, nil
+		}
+	}
+
+	// Failed nodes are only forgotten once the cluster has every healthy node
+	// the scaling opts call for, and only if Consul doesn't consider them
+	// healthy, as they may be on the other side of a network partition.
+	primaries, replicas := countClusterNodes(obs.ClusterNodes)
+	if primaries < scaling.PrimaryCount || replicas < scaling.ReplicaCount {
+		return plan{}, nil
+	}
+	inDest := make(map[string]bool)
+	for _, addr := range obs.NodesInDest {
+		inDest[addr] = true
+	}
+	for _, n := range failed {
+		if n.SlotCount() > 0 || len(redis.ReplicasOf(obs.ClusterNodes, n.ID)) > 0 || inDest[n.Addr] {
+			continue
+		}
+		dest, err := destExcluding(obs, n.ID)
+		if err != nil {
+			return plan{}, err
+		}
+		return plan{[]step{forget(n, dest, "the cluster no longer needs it")}}, nil
+	}
+	return plan{}, nil
+}
+
+// clusterOptions returns the options that tune cluster operations described by
+// `scaling`.
+func clusterOptions(scaling *consul.ScalingOpts) redisCluster.Options {
+	return redisCluster.Options{
+		RebalanceThreshold: scaling.RebalanceThreshold,
+		MigrateBatchSize:   scaling.MigrationPipelineSize,
+		MigrateTimeout:     scaling.Timeouts.Migrate.Duration,
+		ConvergeTimeout:    scaling.Timeouts.Converge.Duration,
+	}
+}
+
+// apply performs the step against the cluster. No further changes are made
+// once `ctx` is cancelled.
+func (s step) apply(ctx context.Context, conf config.RedisOpts, opts redisCluster.Options) error {
+	switch s.Action {
+	case actionCreate:
+		return redisCluster.CreateCluster(ctx, conf, opts, s.Nodes, s.ReplicasPerPrimary)
+	case actionMeet:
+		return redisCluster.Meet(ctx, conf, opts, s.Node, s.Dest)
+	case actionRebalance:
+		return redisCluster.Rebalance(ctx, conf, opts, s.Dest, s.Weights)
+	case actionReplicate:
+		return redisCluster.Replicate(ctx, conf, opts, s.Node, s.PrimaryID)
+	case actionRemove:
+		return redisCluster.RemoveNode(ctx, conf, opts, s.Dest, s.NodeID)
+	case actionAdopt:
+		return redisCluster.AdoptSlots(ctx, conf, opts, s.Node, s.Dest, s.NodeID)
+	}
+	return fmt.Errorf("unknown action %q", s.Action)
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	consul "github.com/letsencrypt/attache/src/consul/client"
+	redis "github.com/letsencrypt/attache/src/redis/client"
+)
+
+func primaryNode(id string, addr string, slots ...redis.SlotRange) redis.ClusterNode {
+	return redis.ClusterNode{ID: id, Addr: addr, Flags: []string{"master"}, LinkState: "connected", Slots: slots}
+}
+
+func replicaNode(id string, addr string, primaryID string) redis.ClusterNode {
+	return redis.ClusterNode{ID: id, Addr: addr, Flags: []string{"slave"}, PrimaryID: primaryID, LinkState: "connected"}
+}
+
+// threeShards is a cluster of 3 shard primaries, the first of which has a
+// replica.
+var threeShards = []redis.ClusterNode{
+	primaryNode("a", "10.0.0.1:6379", redis.SlotRange{Start: 0, End: 5460}),
+	primaryNode("b", "10.0.0.2:6379", redis.SlotRange{Start: 5461, End: 10922}),
+	primaryNode("c", "10.0.0.3:6379", redis.SlotRange{Start: 10923, End: 16383}),
+	replicaNode("d", "10.0.0.4:6379", "a"),
+}
+
+// actions returns the action of each step in `p`.
+func actions(p plan) []action {
+	var got []action
+	for _, s := range p.Steps {
+		got = append(got, s.Action)
+	}
+	return got
+}
+
+func Test_makePlan(t *testing.T) {
+	tests := []struct {
+		name         string
+		obs          observation
+		scaling      consul.ScalingOpts
+		want         []action
+		wantContinue bool
+		wantErr      bool
+	}{
+		{
+			name:         "waiting for nodes to create a cluster",
+			obs:          observation{ThisNode: "10.0.0.1:6379", ThisNodeIsNew: true, NodesInAwait: []string{"10.0.0.1:6379", "10.0.0.2:6379"}},
+			scaling:      consul.ScalingOpts{PrimaryCount: 3, ReplicaCount: 3},
+			wantContinue: true,
+		},
+		{
+			name:    "create a cluster",
+			obs:     observation{ThisNode: "10.0.0.1:6379", ThisNodeIsNew: true, NodesInAwait: []string{"10.0.0.1:6379", "10.0.0.2:6379", "10.0.0.3:6379"}},
+			scaling: consul.ScalingOpts{PrimaryCount: 3, ReplicaCount: 0},
+			want:    []action{actionCreate},
+		},
+		{
+			name:    "bootstrap a cluster of shard primaries",
+			obs:     observation{ThisNode: "10.0.0.1:6379", ThisNodeIsNew: true, NodesInAwait: []string{"10.0.0.1:6379", "10.0.0.2:6379", "10.0.0.3:6379"}},
+			scaling: consul.ScalingOpts{PrimaryCount: 4, ReplicaCount: 4, MinPrimariesToBootstrap: 3},
+			want:    []action{actionCreate},
+		},
+		{
+			name:         "waiting for nodes to bootstrap a cluster",
+			obs:          observation{ThisNode: "10.0.0.1:6379", ThisNodeIsNew: true, NodesInAwait: []string{"10.0.0.1:6379", "10.0.0.2:6379"}},
+			scaling:      consul.ScalingOpts{PrimaryCount: 4, ReplicaCount: 4, MinPrimariesToBootstrap: 3},
+			wantContinue: true,
+		},
+		{
+			name:    "add a shard primary",
+			obs:     observation{ThisNode: "10.0.0.5:6379", ThisNodeIsNew: true, NodesInDest: []string{"10.0.0.1:6379"}, ClusterNodes: threeShards},
+			scaling: consul.ScalingOpts{PrimaryCount: 4, ReplicaCount: 1},
+			want:    []action{actionMeet, actionRebalance},
+		},
+		{
+			name:    "add a shard replica",
+			obs:     observation{ThisNode: "10.0.0.5:6379", ThisNodeIsNew: true, NodesInDest: []string{"10.0.0.1:6379"}, ClusterNodes: threeShards},
+			scaling: consul.ScalingOpts{PrimaryCount: 3, ReplicaCount: 3},
+			want:    []action{actionMeet, actionReplicate},
+		},
+		{
+			name:    "nomad scaled without scaling opts",
+			obs:     observation{ThisNode: "10.0.0.5:6379", ThisNodeIsNew: true, NodesInDest: []string{"10.0.0.1:6379"}, ClusterNodes: threeShards},
+			scaling: consul.ScalingOpts{PrimaryCount: 3, ReplicaCount: 1},
+			wantErr: true,
+		},
+		{
+			name:    "nothing to do",
+			obs:     observation{ThisNode: "10.0.0.1:6379", ClusterNodes: threeShards},
+			scaling: consul.ScalingOpts{PrimaryCount: 3, ReplicaCount: 1},
+		},
+		{
+			name:    "remove a shard primary",
+			obs:     observation{ThisNode: "10.0.0.1:6379", ClusterNodes: threeShards},
+			scaling: consul.ScalingOpts{PrimaryCount: 2, ReplicaCount: 1},
+			want:    []action{actionRebalance, actionReplicate, actionRemove},
+		},
+		{
+			name:    "remove a shard replica",
+			obs:     observation{ThisNode: "10.0.0.1:6379", ClusterNodes: threeShards},
+			scaling: consul.ScalingOpts{PrimaryCount: 3, ReplicaCount: 0},
+			want:    []action{actionRemove},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := makePlan(tt.obs, &tt.scaling, false)
+			if errors.Is(err, errContinue) != tt.wantContinue {
+				t.Fatalf("makePlan() error = %v, wantContinue %v", err, tt.wantContinue)
+			}
+			if (err != nil && !tt.wantContinue) != tt.wantErr {
+				t.Fatalf("makePlan() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(actions(got), tt.want) {
+				t.Errorf("makePlan() actions = %v, want %v", actions(got), tt.want)
+			}
+		})
+	}
+}
+
+func Test_makePlanScaleIn(t *testing.T) {
+	tests := []struct {
+		name     string
+		thisNode string
+		scaling  consul.ScalingOpts
+		want     []step
+	}{
+		{
+			// Shard primaries 'a' and 'c' serve the fewest slots. 'a' is
+			// selected by node ID, so it's drained and its replica is moved to
+			// 'b', the first remaining primary without a replica.
+			name:     "remove a shard primary",
+			thisNode: "10.0.0.3:6379",
+			scaling:  consul.ScalingOpts{PrimaryCount: 2, ReplicaCount: 1},
+			want: []step{
+				{Action: actionRebalance, Dest: "10.0.0.3:6379", Weights: map[string]int{"a": 0}},
+				{Action: actionReplicate, Node: "10.0.0.4:6379", PrimaryID: "b"},
+				{Action: actionRemove, Node: "10.0.0.1:6379", NodeID: "a", Dest: "10.0.0.3:6379"},
+			},
+		},
+		{
+			// This node is reset when it's removed, so every step is performed
+			// against 'b', the remaining primary with the lowest node ID.
+			name:     "remove this shard primary",
+			thisNode: "10.0.0.1:6379",
+			scaling:  consul.ScalingOpts{PrimaryCount: 2, ReplicaCount: 1},
+			want: []step{
+				{Action: actionRebalance, Dest: "10.0.0.2:6379", Weights: map[string]int{"a": 0}},
+				{Action: actionReplicate, Node: "10.0.0.4:6379", PrimaryID: "b"},
+				{Action: actionRemove, Node: "10.0.0.1:6379", NodeID: "a", Dest: "10.0.0.2:6379"},
+			},
+		},
+		{
+			name:     "remove this shard replica",
+			thisNode: "10.0.0.4:6379",
+			scaling:  consul.ScalingOpts{PrimaryCount: 3, ReplicaCount: 0},
+			want: []step{
+				{Action: actionRemove, Node: "10.0.0.4:6379", NodeID: "d", Dest: "10.0.0.1:6379"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := makePlan(observation{ThisNode: tt.thisNode, ClusterNodes: threeShards}, &tt.scaling, false)
+			if err != nil {
+				t.Fatalf("makePlan() error = %v", err)
+			}
+			for i := range got.Steps {
+				got.Steps[i].Description = ""
+			}
+			if !reflect.DeepEqual(got.Steps, tt.want) {
+				t.Errorf("makePlan() = %+v, want %+v", got.Steps, tt.want)
+			}
+		})
+	}
+}
+
+func failed(n redis.ClusterNode) redis.ClusterNode {
+	n.Flags = append(n.Flags, "fail")
+	n.LinkState = "disconnected"
+	return n
+}
+
+func Test_makePlanReplaceFailed(t *testing.T) {
+	tests := []struct {
+		name  string
+		nodes []redis.ClusterNode
+		want  []step
+	}{
+		{
+			// Shard primary 'c' failed without a replica to take over for it,
+			// so the new node adopts its shard slots.
+			name: "failed primary without a replica",
+			nodes: []redis.ClusterNode{
+				threeShards[0], threeShards[1], failed(threeShards[2]), threeShards[3],
+			},
+			want: []step{
+				{Action: actionMeet, Node: "10.0.0.5:6379", Dest: "10.0.0.1:6379"},
+				{Action: actionAdopt, Node: "10.0.0.5:6379", NodeID: "c", Dest: "10.0.0.1:6379"},
+				{Action: actionRemove, Node: "10.0.0.3:6379", NodeID: "c", Dest: "10.0.0.1:6379"},
+			},
+		},
+		{
+			// Shard primary 'a' failed and its replica 'd' took over, leaving
+			// 'd' without a replica.
+			name: "failed primary with a replica",
+			nodes: []redis.ClusterNode{
+				failed(primaryNode("a", "10.0.0.1:6379")),
+				threeShards[1],
+				threeShards[2],
+				primaryNode("d", "10.0.0.4:6379", redis.SlotRange{Start: 0, End: 5460}),
+				replicaNode("e", "10.0.0.6:6379", "b"),
+				replicaNode("f", "10.0.0.7:6379", "c"),
+			},
+			want: []step{
+				{Action: actionMeet, Node: "10.0.0.5:6379", Dest: "10.0.0.2:6379"},
+				{Action: actionReplicate, Node: "10.0.0.5:6379", PrimaryID: "d"},
+				{Action: actionRemove, Node: "10.0.0.1:6379", NodeID: "a", Dest: "10.0.0.2:6379"},
+			},
+		},
+		{
+			// Replica 'd' failed, leaving shard primary 'a' without a replica.
+			name: "failed replica",
+			nodes: []redis.ClusterNode{
+				threeShards[0], threeShards[1], threeShards[2], failed(threeShards[3]),
+			},
+			want: []step{
+				{Action: actionMeet, Node: "10.0.0.5:6379", Dest: "10.0.0.1:6379"},
+				{Action: actionReplicate, Node: "10.0.0.5:6379", PrimaryID: "a"},
+				{Action: actionRemove, Node: "10.0.0.4:6379", NodeID: "d", Dest: "10.0.0.1:6379"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var dest []string
+			for _, n := range tt.nodes {
+				if !n.HasFailed() {
+					dest = append(dest, n.Addr)
+				}
+			}
+			obs := observation{ThisNode: "10.0.0.5:6379", ThisNodeIsNew: true, NodesInDest: dest, ClusterNodes: tt.nodes}
+			got, err := makePlan(obs, &consul.ScalingOpts{PrimaryCount: 3, ReplicaCount: 3}, false)
+			if err != nil {
+				t.Fatalf("makePlan() error = %v", err)
+			}
+			for i := range got.Steps {
+				got.Steps[i].Description = ""
+			}
+			if !reflect.DeepEqual(got.Steps, tt.want) {
+				t.Errorf("makePlan() = %+v, want %+v", got.Steps, tt.want)
+			}
+		})
+	}
+}
+
+func Test_makePlanReconcile(t *testing.T) {
+	tests := []struct {
+		name    string
+		nodes   []redis.ClusterNode
+		dest    []string
+		scaling consul.ScalingOpts
+		want    []step
+	}{
+		{
+			name:    "no drift",
+			nodes:   threeShards,
+			scaling: consul.ScalingOpts{PrimaryCount: 3, ReplicaCount: 1},
+		},
+		{
+			// Shard primary 'c' failed without a replica to take over for it
+			// and 'e' was introduced but never given shard slots.
+			name: "failed primary and an empty primary",
+			nodes: []redis.ClusterNode{
+				threeShards[0], threeShards[1], failed(threeShards[2]), threeShards[3],
+				primaryNode("e", "10.0.0.5:6379"),
+			},
+			scaling: consul.ScalingOpts{PrimaryCount: 3, ReplicaCount: 1},
+			want: []step{
+				{Action: actionAdopt, Node: "10.0.0.5:6379", NodeID: "c", Dest: "10.0.0.1:6379"},
+				{Action: actionRemove, Node: "10.0.0.3:6379", NodeID: "c", Dest: "10.0.0.1:6379"},
+			},
+		},
+		{
+			name:    "empty primary",
+			nodes:   append([]redis.ClusterNode{primaryNode("e", "10.0.0.5:6379")}, threeShards[:3]...),
+			scaling: consul.ScalingOpts{PrimaryCount: 4},
+			want: []step{
+				{Action: actionRebalance, Dest: "10.0.0.1:6379"},
+			},
+		},
+		{
+			// 'a' has both replicas, leaving 'b' and 'c' orphaned.
+			name:    "orphaned primaries",
+			nodes:   append(threeShards, replicaNode("e", "10.0.0.5:6379", "a")),
+			scaling: consul.ScalingOpts{PrimaryCount: 3, ReplicaCount: 3},
+			want: []step{
+				{Action: actionReplicate, Node: "10.0.0.4:6379", PrimaryID: "b"},
+			},
+		},
+		{
+			name: "replicas unevenly spread by one",
+			nodes: append(threeShards,
+				replicaNode("e", "10.0.0.5:6379", "a"),
+				replicaNode("f", "10.0.0.6:6379", "b"),
+				replicaNode("g", "10.0.0.7:6379", "c"),
+			),
+			scaling: consul.ScalingOpts{PrimaryCount: 3, ReplicaCount: 4},
+		},
+		{
+			// Shard primary 'x' failed and its replica 'c' took over.
+			name:    "failed primary that the cluster no longer needs",
+			nodes:   append(threeShards, failed(primaryNode("x", "10.0.0.9:6379"))),
+			scaling: consul.ScalingOpts{PrimaryCount: 3, ReplicaCount: 1},
+			want: []step{
+				{Action: actionRemove, Node: "10.0.0.9:6379", NodeID: "x", Dest: "10.0.0.1:6379"},
+			},
+		},
+		{
+			name:    "failed primary that's healthy in consul",
+			nodes:   append(threeShards, failed(primaryNode("x", "10.0.0.9:6379"))),
+			dest:    []string{"10.0.0.9:6379"},
+			scaling: consul.ScalingOpts{PrimaryCount: 3, ReplicaCount: 1},
+		},
+		{
+			// The cluster is a replica short, so the failed node is left
+			// for a new node to replace.
+			name:    "failed replica that the cluster still needs",
+			nodes:   []redis.ClusterNode{threeShards[0], threeShards[1], threeShards[2], failed(threeShards[3])},
+			scaling: consul.ScalingOpts{PrimaryCount: 3, ReplicaCount: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obs := observation{ThisNode: "10.0.0.1:6379", NodesInDest: tt.dest, ClusterNodes: tt.nodes}
+			got, err := makePlan(obs, &tt.scaling, true)
+			if err != nil {
+				t.Fatalf("makePlan() error = %v", err)
+			}
+			for i := range got.Steps {
+				got.Steps[i].Description = ""
+			}
+			if !reflect.DeepEqual(got.Steps, tt.want) {
+				t.Errorf("makePlan() = %+v, want %+v", got.Steps, tt.want)
+			}
+		})
+	}
+}
@@ -128,7 +128,7 @@ job "redis-cluster" {
           name     = "attache-check:clusterinfo/state/ok"
           type     = "http"
           port     = "attache"
-          path     = "/clusterinfo/state/ok"
+          path     = "/clusterinfo/state/ok?rule=replica-synced"
           interval = "3s"
           timeout  = "2s"
         }
@@ -214,6 +214,14 @@ job "redis-cluster" {
           interval = "3s"
           timeout  = "2s"
         }
+        check {
+          name     = "attache-check:clusterinfo/state/new"
+          type     = "http"
+          port     = "attache"
+          path     = "/clusterinfo/state/new"
+          interval = "3s"
+          timeout  = "2s"
+        }
       }
       driver = "raw_exec"
       config {
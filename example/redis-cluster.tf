@@ -55,6 +55,7 @@ resource "consul_keys" "redis-cluster" {
   key {
     path  = "service/${var.dest-service-name}/scaling"
     value = <<-EOF
+      version: 1
       primary-count: ${var.primary-count}
       replica-count: ${var.replica-count}
     EOF
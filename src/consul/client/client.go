@@ -1,21 +1,46 @@
 package client
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"strings"
+	"time"
 
 	consul "github.com/hashicorp/consul/api"
 	"github.com/letsencrypt/attache/src/consul/config"
+	logger "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v3"
 )
 
+const (
+	// watchWaitTime is the maximum duration of a single blocking query.
+	watchWaitTime = 5 * time.Minute
+
+	// watchRetryInterval is the duration to wait before retrying a blocking
+	// query that failed.
+	watchRetryInterval = 5 * time.Second
+)
+
 // Client is a convenience wrapper for an inner `*consul.Client`.
 type Client struct {
 	*consul.Client
 	serviceName string
+
+	// clusterID, when set, scopes the Client to a single Redis Cluster among
+	// several that share `serviceName`. Only members of `serviceName` with a
+	// tag of `clusterID` are returned and the scaling opts are read from a KV
+	// path that includes `clusterID`.
+	clusterID string
 }
 
-// New creates a new Consul client and returns a `*Client` to the caller.
-func New(conf config.ConsulOpts, serviceName string) (*Client, error) {
+// New creates a new Consul client and returns a `*Client` to the caller. If
+// `clusterID` is not empty the Client is scoped to the Redis Cluster with that
+// identifier.
+func New(conf config.ConsulOpts, serviceName string, clusterID string) (*Client, error) {
 	consulConfig, err := conf.MakeConsulConfig()
 	if err != nil {
 		return nil, err
@@ -25,36 +50,155 @@ func New(conf config.ConsulOpts, serviceName string) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Client{client, serviceName}, nil
+	return &Client{client, serviceName, clusterID}, nil
+}
+
+// Node is a member of a Consul service.
+type Node struct {
+	// Addr is the address of the node in the format <ip>:<port>.
+	Addr string
+
+	// FailureDomain is the value of the service or node meta key used to
+	// describe where the node runs (e.g. the rack or zone). It's empty if no
+	// meta key was requested or neither the service nor the node has it set.
+	FailureDomain string
+}
+
+// nodeFromEntry returns the Node described by `entry`. The failure domain is
+// read from the service meta key `metaKey` or, if the service doesn't have it
+// set, from the node meta key of the same name.
+func nodeFromEntry(entry *consul.ServiceEntry, metaKey string) Node {
+	n := Node{Addr: fmt.Sprintf("%s:%d", entry.Service.Address, entry.Service.Port)}
+	if metaKey == "" {
+		return n
+	}
+	n.FailureDomain = entry.Service.Meta[metaKey]
+	if n.FailureDomain == "" && entry.Node != nil {
+		n.FailureDomain = entry.Node.Meta[metaKey]
+	}
+	return n
+}
+
+// GetNodes queries the Consul Service Catalog for members of the
+// `s.ServiceName`, tagged with `s.clusterID` if set, and returns them to the
+// caller. The failure domain of each node is read from the service or node meta
+// key `metaKey`. When `onlyHealthy` is true Consul will only return nodes that
+// are currently passing all health checks.
+func (s *Client) GetNodes(onlyHealthy bool, metaKey string) ([]Node, error) {
+	entries, _, err := s.Health().Service(s.serviceName, s.clusterID, onlyHealthy, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query consul for service %q: %w", s.serviceName, err)
+	}
+
+	var nodes []Node
+	for _, entry := range entries {
+		nodes = append(nodes, nodeFromEntry(entry, metaKey))
+	}
+	return nodes, nil
 }
 
 // GetNodeAddresses queries the Consul Service Catalog for members of the
-// `s.ServiceName`, constructs a slice of addresses in the format <ip>:<port>
-// which it returns to the caller. When `onlyHealthy` is true Consul will only
-// return nodes that are currently passing all health checks.
+// `s.ServiceName`, tagged with `s.clusterID` if set, constructs a slice of
+// addresses in the format <ip>:<port> which it returns to the caller. When
+// `onlyHealthy` is true Consul will only return nodes that are currently
+// passing all health checks.
 func (s *Client) GetNodeAddresses(onlyHealthy bool) ([]string, error) {
-	nodes, _, err := s.Health().Service(s.serviceName, "", onlyHealthy, nil)
+	nodes, err := s.GetNodes(onlyHealthy, "")
 	if err != nil {
-		return nil, fmt.Errorf("cannot query consul for service %q: %w", s.serviceName, err)
+		return nil, err
 	}
 
 	var addresses []string
-	for _, entry := range nodes {
-		addresses = append(addresses, fmt.Sprintf("%s:%d", entry.Service.Address, entry.Service.Port))
+	for _, n := range nodes {
+		addresses = append(addresses, n.Addr)
 	}
 	return addresses, nil
 }
 
+const (
+	// scalingOptsVersion is the version of the scaling opts schema understood
+	// by this version of Attaché.
+	scalingOptsVersion = 1
+
+	// minPrimaryCount is the minimum count of shard primaries that Redis
+	// Cluster requires.
+	minPrimaryCount = 3
+)
+
+// Duration is a `time.Duration` that's written as a string (e.g. "90s") in
+// both YAML and JSON scaling opts.
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalYAML implements `yaml.Unmarshaler`.
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	var s string
+	err := value.Decode(&s)
+	if err != nil {
+		return err
+	}
+	d.Duration, err = time.ParseDuration(s)
+	return err
+}
+
+// UnmarshalJSON implements `json.Unmarshaler`.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+	d.Duration, err = time.ParseDuration(s)
+	return err
+}
+
+// Timeouts are the maximum durations of individual cluster operations.
+type Timeouts struct {
+	// Converge is the maximum duration to wait for the nodes of a cluster to
+	// agree on a configuration change (e.g. after a node is introduced or a
+	// replica is attached).
+	Converge Duration `yaml:"converge" json:"converge"`
+
+	// Migrate is the maximum idle time of a single 'MIGRATE' command while
+	// shard slots are moved.
+	Migrate Duration `yaml:"migrate" json:"migrate"`
+}
+
 // ScalingOpts defines the expected number of primary and replica nodes in the
-// Redis Cluster being orchestrated by Attaché.
+// Redis Cluster being orchestrated by Attaché, and optionally how cluster
+// operations are tuned. Fields tuning cluster operations that are left at
+// their zero value use the defaults of Attaché.
 type ScalingOpts struct {
+	// Version is the version of the scaling opts schema. When omitted the
+	// current version is assumed.
+	Version int `yaml:"version" json:"version"`
+
 	// PrimaryCount is the count of primary Redis nodes you expect to be present
 	// in the final Redis Cluster.
-	PrimaryCount int `yaml:"primary-count"`
+	PrimaryCount int `yaml:"primary-count" json:"primary-count"`
 
 	// ReplicaCount is the count of replica Redis nodes you expect to be present
 	// in the final Redis Cluster.
-	ReplicaCount int `yaml:"replica-count"`
+	ReplicaCount int `yaml:"replica-count" json:"replica-count"`
+
+	// RebalanceThreshold is the percentage by which the count of shard slots
+	// served by at least one primary must differ from its expected share
+	// before a rebalance moves any slots.
+	RebalanceThreshold int `yaml:"rebalance-threshold" json:"rebalance-threshold"`
+
+	// MigrationPipelineSize is the maximum number of keys moved by a single
+	// 'MIGRATE' command.
+	MigrationPipelineSize int `yaml:"migration-pipeline-size" json:"migration-pipeline-size"`
+
+	// Timeouts are the maximum durations of individual cluster operations.
+	Timeouts Timeouts `yaml:"timeouts" json:"timeouts"`
+
+	// MinPrimariesToBootstrap, when set, allows a new cluster of shard
+	// primaries to be created once this many nodes are waiting, rather than
+	// waiting for every expected node. The remaining nodes join the cluster as
+	// they start.
+	MinPrimariesToBootstrap int `yaml:"min-primaries-to-bootstrap" json:"min-primaries-to-bootstrap"`
 }
 
 // totalCount returns the total count of expected replica and primary nodes.
@@ -68,18 +212,97 @@ func (s *ScalingOpts) NodesMissing(nodesInAwait int) int {
 	return s.totalCount() - nodesInAwait
 }
 
-// ReplicasPerPrimary returns the number of replica nodes per primary shard.
+// ReplicasPerPrimary returns the number of replica nodes per primary shard. It
+// returns 0 if no primaries are expected.
 func (s *ScalingOpts) ReplicasPerPrimary() int {
+	if s.PrimaryCount <= 0 {
+		return 0
+	}
 	return s.ReplicaCount / s.PrimaryCount
 }
 
-// GetScalingOpts fetches the count of Redis primary and replica nodes from KV
-// path: "service/destServiceName/scaling", and return them as a `*ScalingOpts`
+// Validate returns an error describing every problem that prevents the
+// scaling opts from being acted on.
+func (s *ScalingOpts) Validate() error {
+	var problems []string
+	if s.Version != 0 && s.Version != scalingOptsVersion {
+		problems = append(problems, fmt.Sprintf("version %d is not supported, expected %d", s.Version, scalingOptsVersion))
+	}
+	if s.PrimaryCount < minPrimaryCount {
+		problems = append(problems, fmt.Sprintf("primary-count must be at least %d, got %d", minPrimaryCount, s.PrimaryCount))
+	}
+	if s.ReplicaCount < 0 {
+		problems = append(problems, fmt.Sprintf("replica-count must not be negative, got %d", s.ReplicaCount))
+	} else if s.PrimaryCount > 0 && s.ReplicaCount%s.PrimaryCount != 0 {
+		problems = append(problems, fmt.Sprintf("replica-count must be a multiple of primary-count so that every shard has the same number of replicas, got %d replicas for %d primaries", s.ReplicaCount, s.PrimaryCount))
+	}
+	if s.RebalanceThreshold < 0 || s.RebalanceThreshold > 100 {
+		problems = append(problems, fmt.Sprintf("rebalance-threshold must be a percentage between 0 and 100, got %d", s.RebalanceThreshold))
+	}
+	if s.MigrationPipelineSize < 0 {
+		problems = append(problems, fmt.Sprintf("migration-pipeline-size must not be negative, got %d", s.MigrationPipelineSize))
+	}
+	if s.Timeouts.Converge.Duration < 0 {
+		problems = append(problems, fmt.Sprintf("timeouts.converge must not be negative, got %s", s.Timeouts.Converge))
+	}
+	if s.Timeouts.Migrate.Duration < 0 {
+		problems = append(problems, fmt.Sprintf("timeouts.migrate must not be negative, got %s", s.Timeouts.Migrate))
+	}
+	if s.MinPrimariesToBootstrap != 0 && (s.MinPrimariesToBootstrap < minPrimaryCount || s.MinPrimariesToBootstrap > s.PrimaryCount) {
+		problems = append(problems, fmt.Sprintf("min-primaries-to-bootstrap must be between %d and primary-count (%d), got %d", minPrimaryCount, s.PrimaryCount, s.MinPrimariesToBootstrap))
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// parseScalingOpts unmarshals and validates the scaling opts in `value`, which
+// may be a YAML or JSON document. Unknown fields are rejected.
+func parseScalingOpts(value []byte) (*ScalingOpts, error) {
+	var opts ScalingOpts
+	var err error
+	if bytes.HasPrefix(bytes.TrimSpace(value), []byte("{")) {
+		decoder := json.NewDecoder(bytes.NewReader(value))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&opts)
+	} else {
+		decoder := yaml.NewDecoder(bytes.NewReader(value))
+		decoder.KnownFields(true)
+		err = decoder.Decode(&opts)
+		if errors.Is(err, io.EOF) {
+			err = errors.New("document is empty")
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse scaling opts: %w", err)
+	}
+
+	err = opts.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid scaling opts: %w", err)
+	}
+	return &opts, nil
+}
+
+// ScalingOptsKey returns the KV path of the scaling opts:
+// "service/destServiceName/scaling" or, if the Client is scoped to a cluster,
+// "service/destServiceName/clusterID/scaling".
+func (c *Client) ScalingOptsKey() string {
+	if c.clusterID != "" {
+		return fmt.Sprintf("service/%s/%s/scaling", c.serviceName, c.clusterID)
+	}
+	return fmt.Sprintf("service/%s/scaling", c.serviceName)
+}
+
+// GetScalingOpts fetches the count of Redis primary and replica nodes from the
+// KV path returned by ScalingOptsKey, and return them as a `*ScalingOpts`
 // to the caller.
 func (c *Client) GetScalingOpts() (*ScalingOpts, error) {
 	kv := c.KV()
 
-	scalingOptsKey := fmt.Sprintf("service/%s/scaling", c.serviceName)
+	scalingOptsKey := c.ScalingOptsKey()
 	scalingOptsKV, _, err := kv.Get(scalingOptsKey, nil)
 	if err != nil {
 		return nil, fmt.Errorf("cannot get value for key %q: %w", scalingOptsKey, err)
@@ -90,11 +313,62 @@ func (c *Client) GetScalingOpts() (*ScalingOpts, error) {
 	if scalingOptsKV == nil {
 		return nil, fmt.Errorf("key %q is not defined", scalingOptsKey)
 	}
+	return parseScalingOpts(scalingOptsKV.Value)
+}
 
-	var opts ScalingOpts
-	err = yaml.Unmarshal(scalingOptsKV.Value, &opts)
-	if err != nil {
-		return nil, err
+// WatchScalingOpts uses Consul blocking queries to watch the KV path returned
+// by ScalingOptsKey until `ctx` is cancelled. Each time a new
+// value is written to the path it's sent to `updates`. If the new value is
+// invalid it's logged and nil is sent instead, so that the caller can refuse to
+// act until a valid value is written. A missing value is logged and skipped.
+func (c *Client) WatchScalingOpts(ctx context.Context, updates chan<- *ScalingOpts) {
+	kv := c.KV()
+	scalingOptsKey := c.ScalingOptsKey()
+
+	var waitIndex, lastModifyIndex uint64
+	for {
+		opts := (&consul.QueryOptions{WaitIndex: waitIndex, WaitTime: watchWaitTime}).WithContext(ctx)
+		scalingOptsKV, meta, err := kv.Get(scalingOptsKey, opts)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logger.Errorf("cannot watch value for key %q: %s", scalingOptsKey, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(watchRetryInterval):
+			}
+			continue
+		}
+
+		// Per the consul API docs, the index must be reset if it goes
+		// backwards, this can happen if the KV store is restored.
+		if meta.LastIndex < waitIndex {
+			waitIndex = 0
+		} else {
+			waitIndex = meta.LastIndex
+		}
+
+		if scalingOptsKV == nil {
+			logger.Warnf("key %q is not defined, waiting for it to be written", scalingOptsKey)
+			continue
+		}
+		if scalingOptsKV.ModifyIndex == lastModifyIndex {
+			// The blocking query timed out without a change.
+			continue
+		}
+		lastModifyIndex = scalingOptsKV.ModifyIndex
+
+		scaling, err := parseScalingOpts(scalingOptsKV.Value)
+		if err != nil {
+			logger.Errorf("value for key %q is invalid: %s", scalingOptsKey, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case updates <- scaling:
+		}
 	}
-	return &opts, nil
 }
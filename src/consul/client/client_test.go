@@ -1,8 +1,11 @@
 package client
 
 import (
+	"reflect"
 	"testing"
+	"time"
 
+	consul "github.com/hashicorp/consul/api"
 	"github.com/letsencrypt/attache/src/consul/config"
 )
 
@@ -14,7 +17,7 @@ func TestNew(t *testing.T) {
 		TLSCertFile:   "../../../example/tls/attache/consul/dev-general-client-consul-0.pem",
 		TLSKeyFile:    "../../../example/tls/attache/consul/dev-general-client-consul-0-key.pem",
 	}
-	client, err := New(config, "test")
+	client, err := New(config, "test", "")
 	if err != nil {
 		t.Fatalf("failed to make client: %s", err)
 	}
@@ -23,3 +26,107 @@ func TestNew(t *testing.T) {
 		t.Fatal("no error but client was nil")
 	}
 }
+
+func TestScalingOptsKey(t *testing.T) {
+	tests := []struct {
+		clusterID string
+		want      string
+	}{
+		{"", "service/redis/scaling"},
+		{"cluster-a", "service/redis/cluster-a/scaling"},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			c := &Client{serviceName: "redis", clusterID: tt.clusterID}
+			got := c.ScalingOptsKey()
+			if got != tt.want {
+				t.Errorf("ScalingOptsKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseScalingOpts(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    *ScalingOpts
+		wantErr bool
+	}{
+		{"primary-count: 3\nreplica-count: 3\n", &ScalingOpts{PrimaryCount: 3, ReplicaCount: 3}, false},
+		{"primary-count: 3\n", &ScalingOpts{PrimaryCount: 3, ReplicaCount: 0}, false},
+		{"replica-count: 3\n", nil, true},
+		{"primary-count: 3\nreplica-count: -1\n", nil, true},
+		{"primary-count: three\n", nil, true},
+		{
+			"version: 1\nprimary-count: 3\nreplica-count: 6\nrebalance-threshold: 2\nmigration-pipeline-size: 100\ntimeouts:\n  converge: 90s\n  migrate: 2m\nmin-primaries-to-bootstrap: 3\n",
+			&ScalingOpts{
+				Version:                 1,
+				PrimaryCount:            3,
+				ReplicaCount:            6,
+				RebalanceThreshold:      2,
+				MigrationPipelineSize:   100,
+				Timeouts:                Timeouts{Converge: Duration{90 * time.Second}, Migrate: Duration{2 * time.Minute}},
+				MinPrimariesToBootstrap: 3,
+			},
+			false,
+		},
+		{
+			`{"version": 1, "primary-count": 3, "replica-count": 3, "timeouts": {"converge": "90s"}}`,
+			&ScalingOpts{Version: 1, PrimaryCount: 3, ReplicaCount: 3, Timeouts: Timeouts{Converge: Duration{90 * time.Second}}},
+			false,
+		},
+		{"", nil, true},
+		{`{"primary-count": 3, "replica-count": 3, "replicas": 1}`, nil, true},
+		{"primary-count: 3\nreplicas: 1\n", nil, true},
+		{"version: 2\nprimary-count: 3\n", nil, true},
+		{"primary-count: 0\n", nil, true},
+		{"primary-count: 2\nreplica-count: 2\n", nil, true},
+		{"primary-count: 3\nreplica-count: 4\n", nil, true},
+		{"primary-count: 3\nrebalance-threshold: 101\n", nil, true},
+		{"primary-count: 3\nmigration-pipeline-size: -1\n", nil, true},
+		{"primary-count: 3\ntimeouts:\n  migrate: soon\n", nil, true},
+		{"primary-count: 3\ntimeouts:\n  migrate: -1s\n", nil, true},
+		{"primary-count: 4\nmin-primaries-to-bootstrap: 5\n", nil, true},
+		{"primary-count: 4\nmin-primaries-to-bootstrap: 2\n", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			got, err := parseScalingOpts([]byte(tt.value))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseScalingOpts() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseScalingOpts() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_nodeFromEntry(t *testing.T) {
+	entry := func(serviceMeta, nodeMeta map[string]string) *consul.ServiceEntry {
+		return &consul.ServiceEntry{
+			Node:    &consul.Node{Meta: nodeMeta},
+			Service: &consul.AgentService{Address: "10.0.0.1", Port: 6379, Meta: serviceMeta},
+		}
+	}
+
+	tests := []struct {
+		entry   *consul.ServiceEntry
+		metaKey string
+		want    Node
+	}{
+		{entry(nil, map[string]string{"rack": "r1"}), "", Node{Addr: "10.0.0.1:6379"}},
+		{entry(nil, map[string]string{"rack": "r1"}), "rack", Node{Addr: "10.0.0.1:6379", FailureDomain: "r1"}},
+		{entry(map[string]string{"rack": "r2"}, map[string]string{"rack": "r1"}), "rack", Node{Addr: "10.0.0.1:6379", FailureDomain: "r2"}},
+		{entry(nil, nil), "rack", Node{Addr: "10.0.0.1:6379"}},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			got := nodeFromEntry(tt.entry, tt.metaKey)
+			if got != tt.want {
+				t.Errorf("nodeFromEntry() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package journal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/letsencrypt/attache/src/consul/config"
+)
+
+// Journal is a convenience wrapper around an inner `*consul.Client` with
+// methods to load, save and delete a single JSON document at a Consul KV path.
+// This is used by attache-control to record the progress of a multi-step
+// cluster operation so that, if the lock holder dies part way through, the
+// next lock holder can finish it.
+//
+// Every write is a check-and-set on the ModifyIndex of the document last
+// loaded or saved, so that a lock holder that has lost the lock, but doesn't
+// know it yet, can't overwrite or delete the journal of the next lock holder.
+// The document isn't acquired with the session of the lock because that
+// session deletes the keys it holds when it's invalidated, which would discard
+// the journal at the very moment it's needed.
+type Journal struct {
+	client *consul.Client
+	key    string
+
+	// index is the ModifyIndex of the document last loaded or saved, or 0 if
+	// there was none.
+	index uint64
+}
+
+// ErrModified is returned when the document was modified or deleted, by
+// another lock holder, since it was last loaded or saved.
+var ErrModified = errors.New("journal was modified by another lock holder")
+
+// New creates a new Consul client and returns a `*Journal` for the Consul KV
+// path of `key` to the caller.
+func New(conf config.ConsulOpts, key string) (*Journal, error) {
+	consulConfig, err := conf.MakeConsulConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := consul.NewClient(consulConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{client: client, key: key}, nil
+}
+
+// Load unmarshals the JSON document at the Consul KV path of `j.key` into `v`.
+// It returns false, and leaves `v` untouched, if no document exists. Subsequent
+// calls to Save and Delete only succeed if the document hasn't been modified
+// since.
+func (j *Journal) Load(v interface{}) (bool, error) {
+	kvPair, _, err := j.client.KV().Get(j.key, nil)
+	if err != nil {
+		return false, fmt.Errorf("cannot read journal at %q: %w", j.key, err)
+	}
+	if kvPair == nil {
+		j.index = 0
+		return false, nil
+	}
+	j.index = kvPair.ModifyIndex
+
+	err = json.Unmarshal(kvPair.Value, v)
+	if err != nil {
+		return false, fmt.Errorf("cannot parse journal at %q: %w", j.key, err)
+	}
+	return true, nil
+}
+
+// Save marshals `v` as JSON and stores it at the Consul KV path of `j.key`,
+// replacing the document last loaded or saved. If no document was loaded, it's
+// only stored if none exists. ErrModified is returned if the document has been
+// modified since it was last loaded or saved.
+func (j *Journal) Save(v interface{}) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	ok, _, err := j.client.KV().CAS(&consul.KVPair{Key: j.key, Value: value, ModifyIndex: j.index}, nil)
+	if err != nil {
+		return fmt.Errorf("cannot write journal at %q: %w", j.key, err)
+	}
+	if !ok {
+		return fmt.Errorf("cannot write journal at %q: %w", j.key, ErrModified)
+	}
+
+	// Consul doesn't return the ModifyIndex of a write, so it's read back. If
+	// the document differs, another lock holder wrote it in the meantime.
+	kvPair, _, err := j.client.KV().Get(j.key, nil)
+	if err != nil {
+		return fmt.Errorf("cannot read journal at %q: %w", j.key, err)
+	}
+	if kvPair == nil || !bytes.Equal(kvPair.Value, value) {
+		return fmt.Errorf("cannot write journal at %q: %w", j.key, ErrModified)
+	}
+	j.index = kvPair.ModifyIndex
+	return nil
+}
+
+// Delete removes the document at the Consul KV path of `j.key` if it hasn't
+// been modified since it was last loaded or saved, otherwise ErrModified is
+// returned. It does nothing if no document was loaded or saved.
+func (j *Journal) Delete() error {
+	if j.index == 0 {
+		return nil
+	}
+
+	ok, _, err := j.client.KV().DeleteCAS(&consul.KVPair{Key: j.key, ModifyIndex: j.index}, nil)
+	if err != nil {
+		return fmt.Errorf("cannot delete journal at %q: %w", j.key, err)
+	}
+	if !ok {
+		return fmt.Errorf("cannot delete journal at %q: %w", j.key, ErrModified)
+	}
+	j.index = 0
+	return nil
+}
@@ -0,0 +1,209 @@
+package journal
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// fakeKV is an in-memory implementation of the subset of the Consul KV HTTP API
+// used by Journal, including check-and-set writes and deletes.
+type fakeKV struct {
+	mu    sync.Mutex
+	index uint64
+	pairs map[string]*consul.KVPair
+}
+
+func (f *fakeKV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	pair := f.pairs[key]
+
+	// casOk reports whether a write guarded by the 'cas' query parameter, if
+	// any, may proceed.
+	casOk := func() bool {
+		cas := r.URL.Query().Get("cas")
+		if cas == "" {
+			return true
+		}
+		index, err := strconv.ParseUint(cas, 10, 64)
+		if err != nil {
+			return false
+		}
+		if index == 0 {
+			return pair == nil
+		}
+		return pair != nil && pair.ModifyIndex == index
+	}
+
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+	switch r.Method {
+	case http.MethodGet:
+		if pair == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode([]*consul.KVPair{pair})
+	case http.MethodPut:
+		if !casOk() {
+			_, _ = io.WriteString(w, "false")
+			return
+		}
+		value, _ := io.ReadAll(r.Body)
+		f.index++
+		f.pairs[key] = &consul.KVPair{Key: key, Value: value, ModifyIndex: f.index}
+		_, _ = io.WriteString(w, "true")
+	case http.MethodDelete:
+		if !casOk() {
+			_, _ = io.WriteString(w, "false")
+			return
+		}
+		f.index++
+		delete(f.pairs, key)
+		_, _ = io.WriteString(w, "true")
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// newTestJournals returns `n` Journals, as held by different lock holders, for
+// the same key in a fake Consul KV store.
+func newTestJournals(t *testing.T, n int) []*Journal {
+	t.Helper()
+	srv := httptest.NewServer(&fakeKV{pairs: make(map[string]*consul.KVPair)})
+	t.Cleanup(srv.Close)
+
+	client, err := consul.NewClient(&consul.Config{Address: strings.TrimPrefix(srv.URL, "http://")})
+	if err != nil {
+		t.Fatalf("failed to make client: %s", err)
+	}
+
+	var journals []*Journal
+	for i := 0; i < n; i++ {
+		journals = append(journals, &Journal{client: client, key: "service/redis/journal"})
+	}
+	return journals
+}
+
+type doc struct {
+	Completed int `json:"completed"`
+}
+
+func TestJournal(t *testing.T) {
+	j := newTestJournals(t, 1)[0]
+
+	var got doc
+	found, err := j.Load(&got)
+	if err != nil || found {
+		t.Fatalf("Load() = %t, %v, want false, nil", found, err)
+	}
+
+	for i := 1; i <= 2; i++ {
+		err = j.Save(doc{Completed: i})
+		if err != nil {
+			t.Fatalf("Save() error = %v", err)
+		}
+	}
+
+	found, err = j.Load(&got)
+	if err != nil || !found {
+		t.Fatalf("Load() = %t, %v, want true, nil", found, err)
+	}
+	if got.Completed != 2 {
+		t.Errorf("Load() loaded %+v, want %+v", got, doc{Completed: 2})
+	}
+
+	err = j.Delete()
+	if err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	found, err = j.Load(&got)
+	if err != nil || found {
+		t.Fatalf("Load() after Delete() = %t, %v, want false, nil", found, err)
+	}
+}
+
+func TestJournalModified(t *testing.T) {
+	tests := []struct {
+		name string
+
+		// interleave is run against the journals of a stale lock holder and
+		// of the next lock holder, after the stale holder has saved once.
+		interleave func(stale, next *Journal) error
+	}{
+		{
+			name: "stale holder saves after next holder loads and saves",
+			interleave: func(stale, next *Journal) error {
+				_, err := next.Load(&doc{})
+				if err != nil {
+					return err
+				}
+				err = next.Save(doc{Completed: 2})
+				if err != nil {
+					return err
+				}
+				return stale.Save(doc{Completed: 3})
+			},
+		},
+		{
+			name: "stale holder deletes after next holder loads and saves",
+			interleave: func(stale, next *Journal) error {
+				_, err := next.Load(&doc{})
+				if err != nil {
+					return err
+				}
+				err = next.Save(doc{Completed: 2})
+				if err != nil {
+					return err
+				}
+				return stale.Delete()
+			},
+		},
+		{
+			name: "stale holder saves after next holder deletes",
+			interleave: func(stale, next *Journal) error {
+				_, err := next.Load(&doc{})
+				if err != nil {
+					return err
+				}
+				err = next.Delete()
+				if err != nil {
+					return err
+				}
+				return stale.Save(doc{Completed: 3})
+			},
+		},
+		{
+			name: "holder that didn't load saves over an existing journal",
+			interleave: func(stale, next *Journal) error {
+				return next.Save(doc{Completed: 2})
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			journals := newTestJournals(t, 2)
+			stale, next := journals[0], journals[1]
+
+			err := stale.Save(doc{Completed: 1})
+			if err != nil {
+				t.Fatalf("Save() error = %v", err)
+			}
+
+			err = tt.interleave(stale, next)
+			if !errors.Is(err, ErrModified) {
+				t.Errorf("got error %v, want %v", err, ErrModified)
+			}
+		})
+	}
+}
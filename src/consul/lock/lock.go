@@ -1,27 +1,101 @@
 package client
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
 	consul "github.com/hashicorp/consul/api"
 	"github.com/letsencrypt/attache/src/consul/config"
 	logger "github.com/sirupsen/logrus"
 )
 
+const (
+	// watchWaitTime is the maximum duration of a single blocking query on the
+	// lock key.
+	watchWaitTime = 5 * time.Minute
+
+	// watchRetryInterval is the duration to wait before retrying a blocking
+	// query on the lock key that failed.
+	watchRetryInterval = time.Second
+
+	// minAcquireBackoff is the initial duration to back off for after an
+	// attempt to acquire a free lock fails.
+	minAcquireBackoff = 500 * time.Millisecond
+
+	// maxAcquireBackoff is the maximum duration to back off for after an
+	// attempt to acquire a free lock fails.
+	maxAcquireBackoff = 30 * time.Second
+)
+
+// SessionOpts configures the Consul session used to hold a Lock.
+type SessionOpts struct {
+	// TTL is the duration after which the session is invalidated, releasing
+	// the lock, unless it's renewed.
+	TTL time.Duration
+
+	// LockDelay is the duration, after the session is invalidated, during
+	// which the lock can't be acquired by another session.
+	LockDelay time.Duration
+
+	// Checks are the IDs of health checks, registered with the local Consul
+	// agent, that the session is tied to. If any of them becomes critical the
+	// session is invalidated, releasing the lock. When empty, Consul ties the
+	// session to the 'serfHealth' check of the agent.
+	Checks []string
+}
+
+// Holder describes the holder of a Lock. It's stored as JSON in the lock key so
+// that operators can tell which node holds the lock and what it's doing.
+type Holder struct {
+	// NodeAddr is the address of the Redis node that the holder is a sidecar
+	// to.
+	NodeAddr string `json:"node-addr"`
+
+	// AllocID is the Nomad allocation ID of the holder, if known.
+	AllocID string `json:"alloc-id,omitempty"`
+
+	// Operation describes the operation the holder is performing, if any.
+	Operation string `json:"operation,omitempty"`
+
+	// Since is the time the lock was acquired.
+	Since time.Time `json:"since"`
+}
+
 // Lock is a convenience wrapper around an inner `*consul.Client` with methods
 // to aquire and release a mutually exclusive distributed lock using Consul
 // sessions. This is used by attache-control to ensure that only one Redis
-// Cluster node operation (create, add, remove) happens at once.
+// Cluster node operation (create, add, remove) happens at once. A single
+// session is created lazily and reused by every attempt to acquire the lock
+// until it's invalidated or destroyed by Cleanup.
 type Lock struct {
-	Acquired       bool
-	client         *consul.Client
-	key            string
-	sessionID      string
-	sessionTimeout string
-	renewChan      chan struct{}
+	Acquired bool
+	client   *consul.Client
+	key      string
+	opts     SessionOpts
+	holder   Holder
+
+	// rand is used to add jitter to backoffs. It's seeded per Lock so that
+	// nodes started together don't back off in lockstep.
+	rand *rand.Rand
+
+	// mu guards sessionID, renewChan, ctx and cancel, which are modified by
+	// the goroutine renewing the session when the session is lost.
+	mu        sync.Mutex
+	sessionID string
+	renewChan chan struct{}
+
+	// ctx is cancelled when the lock is lost or released.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-// New creates a new Consul client, aquires an ephemeral session with that
-// client, and returns a `*Lock` to the caller.
-func New(conf config.ConsulOpts, key string, sessionTimeout string) (*Lock, error) {
+// New creates a new Consul client and returns a `*Lock` for the Consul KV path
+// of `key` to the caller.
+func New(conf config.ConsulOpts, key string, opts SessionOpts) (*Lock, error) {
 	consulConfig, err := conf.MakeConsulConfig()
 	if err != nil {
 		return nil, err
@@ -31,84 +105,361 @@ func New(conf config.ConsulOpts, key string, sessionTimeout string) (*Lock, erro
 	if err != nil {
 		return nil, err
 	}
-	lock := &Lock{
-		client:         client,
-		key:            key,
-		sessionTimeout: sessionTimeout,
-	}
 
-	err = lock.createSession()
-	if err != nil {
-		return nil, err
-	}
-	return lock, err
+	// The lock isn't held yet, so its context starts out cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return &Lock{
+		client: client,
+		key:    key,
+		opts:   opts,
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		ctx:    ctx,
+		cancel: cancel,
+	}, nil
 }
 
-// createSession creates a new ephemeral session using the Consul client. Any
-// data stored during this session will be deleted once the session expires.
-func (l *Lock) createSession() error {
+// session returns the ID of the session used to hold the lock, creating a new
+// ephemeral session, and spinning off a long-running goroutine to continuously
+// renew it, if one doesn't exist. Any data stored during this session will be
+// deleted once the session expires.
+func (l *Lock) session() (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.sessionID != "" {
+		return l.sessionID, nil
+	}
+
 	sessionConf := &consul.SessionEntry{
-		TTL:      l.sessionTimeout,
-		Behavior: "delete",
+		TTL:       l.opts.TTL.String(),
+		LockDelay: l.opts.LockDelay,
+		Checks:    l.opts.Checks,
+		Behavior:  "delete",
 	}
 
 	sessionID, _, err := l.client.Session().Create(sessionConf, nil)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	l.sessionID = sessionID
-	return nil
+	l.renewChan = make(chan struct{})
+	go l.periodicallyRenew(sessionID, l.renewChan)
+	return sessionID, nil
+}
+
+// Context returns a context that's cancelled when the lock is lost, because
+// the session couldn't be renewed or the lock key was taken by another
+// session, or when the lock is released. Every operation performed while
+// holding the lock should be bound to it.
+func (l *Lock) Context() context.Context {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.ctx
 }
 
-// Acquire attempts to obtain a lock for the Consul KV path of `l.key`. Sets `l.Acquired`
-// true on success and false on failure.
-func (l *Lock) Acquire() error {
+// jitter returns a random duration between half of `d` and `d`.
+func (l *Lock) jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(l.rand.Int63n(int64(d/2)+1))
+}
+
+// sleep waits for `d` or until `ctx` is cancelled, whichever is first. It
+// returns false if `ctx` was cancelled.
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// Acquire blocks until it obtains a lock for the Consul KV path of `l.key` or
+// `ctx` is cancelled. Sets `l.Acquired` true on success and false on failure.
+// On success `holder`, with the time the lock was acquired, is stored in the
+// lock key.
+// While the lock is held by another session, Consul blocking queries are used
+// to wait for the key to be released. Attempts to acquire a free lock that
+// fail, because another waiter won the race or the lock-delay of the previous
+// holder hasn't elapsed, are retried with jittered exponential backoff. A key
+// that's still held by this Lock's own session is acquired again.
+func (l *Lock) Acquire(ctx context.Context, holder Holder) error {
+	l.Acquired = false
+	var waitIndex uint64
+	backoff := minAcquireBackoff
+	for attempt := 0; ; attempt++ {
+		opts := (&consul.QueryOptions{WaitIndex: waitIndex, WaitTime: watchWaitTime}).WithContext(ctx)
+		kvPair, meta, err := l.client.KV().Get(l.key, opts)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			logger.Errorf("cannot watch lock key %q: %s", l.key, err)
+			if !sleep(ctx, watchRetryInterval) {
+				return nil
+			}
+			continue
+		}
+		waitIndex = nextWaitIndex(meta.LastIndex, waitIndex)
+
+		l.mu.Lock()
+		sessionID := l.sessionID
+		l.mu.Unlock()
+		if heldByOther(kvPair, sessionID) {
+			// Held by another session, block until it's released.
+			continue
+		}
+
+		// Every waiter wakes when the lock is released, so spread out their
+		// attempts to acquire it. If the key is still held by our own session,
+		// such as when deleting it on Release failed, acquiring it again
+		// succeeds immediately.
+		ownSession := kvPair != nil && kvPair.Session != ""
+		if attempt > 0 && !ownSession && !sleep(ctx, l.jitter(backoff)) {
+			return nil
+		}
+
+		holder.Since = time.Now().UTC()
+		l.Acquired, err = l.tryAcquire(holder)
+		if err != nil {
+			logger.Errorf("cannot acquire lock key %q: %s", l.key, err)
+		}
+		if l.Acquired {
+			return nil
+		}
+
+		// Don't block on the next query, the key may still be free.
+		waitIndex = 0
+		backoff *= 2
+		if backoff > maxAcquireBackoff {
+			backoff = maxAcquireBackoff
+		}
+	}
+}
+
+// heldByOther returns true if `kvPair`, the lock key, is held by a session
+// other than `sessionID`, the session of this Lock.
+func heldByOther(kvPair *consul.KVPair, sessionID string) bool {
+	return kvPair != nil && kvPair.Session != "" && kvPair.Session != sessionID
+}
+
+// tryAcquire makes a single attempt to acquire the lock using the session. On
+// success the context of the lock is replaced and a long-running goroutine is
+// spun off to detect the loss of the lock.
+func (l *Lock) tryAcquire(holder Holder) (bool, error) {
+	sessionID, err := l.session()
+	if err != nil {
+		return false, err
+	}
+
+	acquired, err := l.put(sessionID, holder)
+	if err != nil || !acquired {
+		return false, err
+	}
+	l.holder = holder
+
+	l.mu.Lock()
+	l.ctx, l.cancel = context.WithCancel(context.Background())
+	ctx, cancel := l.ctx, l.cancel
+	l.mu.Unlock()
+
+	go l.watchKey(ctx, cancel, sessionID)
+	return true, nil
+}
+
+// put stores `holder` as JSON in the lock key using `sessionID`. It returns
+// false if the lock is held by another session.
+func (l *Lock) put(sessionID string, holder Holder) (bool, error) {
+	value, err := json.Marshal(holder)
+	if err != nil {
+		return false, err
+	}
+
 	kvPair := &consul.KVPair{
 		Key:     l.key,
-		Value:   []byte(l.sessionID),
-		Session: l.sessionID,
+		Value:   value,
+		Session: sessionID,
 	}
+	acquired, _, err := l.client.KV().Acquire(kvPair, nil)
+	return acquired, err
+}
 
-	var err error
-	l.Acquired, _, err = l.client.KV().Acquire(kvPair, nil)
-	if l.Acquired {
-		// Spin off a long-running go-routine to continuously renew our session.
-		go l.periodicallyRenew()
+// SetOperation records `operation` as the operation being performed by the
+// holder in the lock key. It's a no-op if the lock isn't held.
+func (l *Lock) SetOperation(operation string) error {
+	if !l.Acquired {
+		return nil
 	}
-	return err
+
+	l.mu.Lock()
+	sessionID := l.sessionID
+	l.mu.Unlock()
+
+	l.holder.Operation = operation
+	acquired, err := l.put(sessionID, l.holder)
+	if err != nil {
+		return fmt.Errorf("cannot update lock key %q: %w", l.key, err)
+	}
+	if !acquired {
+		return fmt.Errorf("cannot update lock key %q, it's no longer held by session %q", l.key, sessionID)
+	}
+	return nil
 }
 
-// periodicallyRenew will invoke periodicallyRenew() before l.sessionTimeout on
-// a session until a l.renewChan is closed, it should only be called from a long
-// running goroutine.
-func (l *Lock) periodicallyRenew() {
-	l.renewChan = make(chan struct{})
-	err := l.client.Session().RenewPeriodic(l.sessionTimeout, l.sessionID, nil, l.renewChan)
+// Inspect returns the ID of the session holding the lock and, if the lock key
+// holds a Holder document, the holder. An empty session ID is returned if the
+// lock isn't held.
+func (l *Lock) Inspect() (string, *Holder, error) {
+	kvPair, _, err := l.client.KV().Get(l.key, nil)
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot read lock key %q: %w", l.key, err)
+	}
+	if kvPair == nil || kvPair.Session == "" {
+		return "", nil, nil
+	}
+
+	var holder Holder
+	err = json.Unmarshal(kvPair.Value, &holder)
 	if err != nil {
-		logger.Error(err)
+		// Written by an older version of attache-control, the value is just
+		// the session ID.
+		return kvPair.Session, nil, nil
 	}
+	return kvPair.Session, &holder, nil
 }
 
-// Cleanup stops periodic session renewals used to hold the lock, releases the
-// lock by deleting the key, and destroys the session. Deleting the key and
-// destroying the session only need to be best effort. In the event that either
-// of these calls fail the lock will be released and the session will be
-// destroyed l.sessionTimeout after l.renewChan is closed.
-func (l *Lock) Cleanup() {
-	if l.Acquired {
-		// Halt periodic session renewals.
-		close(l.renewChan)
+// ForceRelease releases the lock, if it's still held by `sessionID`, by
+// destroying that session. The holder will fail to renew the session and
+// abandon any operation in progress.
+func (l *Lock) ForceRelease(sessionID string) error {
+	heldBy, _, err := l.Inspect()
+	if err != nil {
+		return err
+	}
+	if heldBy != sessionID {
+		return fmt.Errorf("lock key %q is no longer held by session %q", l.key, sessionID)
+	}
+
+	_, err = l.client.Session().Destroy(sessionID, nil)
+	if err != nil {
+		return fmt.Errorf("cannot destroy session %q: %w", sessionID, err)
+	}
+	return nil
+}
+
+// nextWaitIndex returns the index to use for the next blocking query given the
+// index returned by the last one. Per the consul API docs, the index must be
+// reset if it goes backwards, this can happen if the KV store is restored.
+func nextWaitIndex(lastIndex, waitIndex uint64) uint64 {
+	if lastIndex < waitIndex {
+		return 0
+	}
+	return lastIndex
+}
+
+// periodicallyRenew will renew `sessionID` before l.opts.TTL until `renewChan`
+// is closed, it should only be called from a long running goroutine. If the
+// session can't be renewed the lock, if held, is considered lost and a new
+// session is created by the next attempt to acquire the lock.
+func (l *Lock) periodicallyRenew(sessionID string, renewChan chan struct{}) {
+	err := l.client.Session().RenewPeriodic(l.opts.TTL.String(), sessionID, nil, renewChan)
+	if err == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.sessionID != sessionID {
+		// Already destroyed by Cleanup.
+		return
+	}
+	if l.ctx.Err() == nil {
+		logger.Errorf("lost the lock on key %q, cannot renew session %q: %s", l.key, sessionID, err)
+		l.cancel()
+	} else {
+		logger.Warnf("cannot renew session %q, a new session will be created: %s", sessionID, err)
+	}
+	l.sessionID = ""
+}
 
-		// Delete the key holding the lock.
-		_, err := l.client.KV().Delete(l.key, nil)
+// watchKey uses Consul blocking queries to watch the lock key until `ctx` is
+// cancelled. If the key is deleted, or is held by a session other than
+// `sessionID`, the lock is considered lost and `cancel` is called. It should
+// only be called from a long running goroutine.
+func (l *Lock) watchKey(ctx context.Context, cancel context.CancelFunc, sessionID string) {
+	var waitIndex uint64
+	for {
+		opts := (&consul.QueryOptions{WaitIndex: waitIndex, WaitTime: watchWaitTime}).WithContext(ctx)
+		kvPair, meta, err := l.client.KV().Get(l.key, opts)
+		if ctx.Err() != nil {
+			return
+		}
 		if err != nil {
-			logger.Errorf("cannot lock key %q: %s", l.key, err)
+			logger.Errorf("cannot watch lock key %q: %s", l.key, err)
+			if !sleep(ctx, watchRetryInterval) {
+				return
+			}
+			continue
+		}
+
+		if kvPair == nil || kvPair.Session != sessionID {
+			logger.Errorf("lost the lock on key %q, it's no longer held by session %q", l.key, sessionID)
+			cancel()
+			return
 		}
-		l.Acquired = false
+		waitIndex = nextWaitIndex(meta.LastIndex, waitIndex)
+	}
+}
+
+// deleteKey deletes the lock key if it's still held by `sessionID`.
+func (l *Lock) deleteKey(sessionID string) error {
+	kvPair, _, err := l.client.KV().Get(l.key, nil)
+	if err != nil {
+		return err
+	}
+	if kvPair == nil || kvPair.Session != sessionID {
+		return nil
+	}
+	_, _, err = l.client.KV().DeleteCAS(kvPair, nil)
+	return err
+}
+
+// Release releases the lock, if it's held, by deleting the key. The session is
+// kept so that it can be reused by the next attempt to acquire the lock.
+// Deleting the key only needs to be best effort. In the event that it fails
+// the lock will be released once the session is destroyed by Cleanup.
+func (l *Lock) Release() {
+	l.mu.Lock()
+	// Cancel the context first so that the loss of the key isn't reported.
+	l.cancel()
+	sessionID := l.sessionID
+	l.mu.Unlock()
 
+	if l.Acquired && sessionID != "" {
+		// Delete the key holding the lock, unless it's since been taken by
+		// another session.
+		err := l.deleteKey(sessionID)
+		if err != nil {
+			logger.Errorf("cannot delete lock key %q: %s", l.key, err)
+		}
 	}
+	l.Acquired = false
+	l.holder = Holder{}
+}
+
+// Cleanup releases the lock, stops periodic session renewals, and destroys the
+// session. Destroying the session only needs to be best effort. In the event
+// that it fails the session will be destroyed l.opts.TTL after renewals stop.
+func (l *Lock) Cleanup() {
+	l.Release()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
 	if l.sessionID != "" {
+		// Halt periodic session renewals.
+		close(l.renewChan)
+
 		// Destroy the session.
 		_, err := l.client.Session().Destroy(l.sessionID, nil)
 		if err != nil {
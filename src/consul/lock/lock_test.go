@@ -0,0 +1,64 @@
+package client
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+func Test_jitter(t *testing.T) {
+	l := &Lock{rand: rand.New(rand.NewSource(1))}
+	for _, d := range []time.Duration{0, 1, minAcquireBackoff, maxAcquireBackoff} {
+		for i := 0; i < 100; i++ {
+			got := l.jitter(d)
+			if got < d/2 || got > d {
+				t.Fatalf("jitter(%s) = %s, want between %s and %s", d, got, d/2, d)
+			}
+		}
+	}
+}
+
+func Test_nextWaitIndex(t *testing.T) {
+	tests := []struct {
+		name      string
+		lastIndex uint64
+		waitIndex uint64
+		want      uint64
+	}{
+		{"first query", 10, 0, 10},
+		{"index moved forward", 12, 10, 12},
+		{"index unchanged", 10, 10, 10},
+		{"index went backwards", 5, 10, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextWaitIndex(tt.lastIndex, tt.waitIndex); got != tt.want {
+				t.Errorf("nextWaitIndex() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_heldByOther(t *testing.T) {
+	tests := []struct {
+		name      string
+		kvPair    *consul.KVPair
+		sessionID string
+		want      bool
+	}{
+		{"no key", nil, "ours", false},
+		{"released", &consul.KVPair{}, "ours", false},
+		{"held by another session", &consul.KVPair{Session: "theirs"}, "ours", true},
+		{"held by our session", &consul.KVPair{Session: "ours"}, "ours", false},
+		{"held before our session exists", &consul.KVPair{Session: "theirs"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := heldByOther(tt.kvPair, tt.sessionID); got != tt.want {
+				t.Errorf("heldByOther() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,12 +2,8 @@ package client
 
 import (
 	"context"
-	"encoding/csv"
-	"errors"
 	"fmt"
-	"io"
 	"reflect"
-	"sort"
 	"strconv"
 	"strings"
 
@@ -24,88 +20,92 @@ type Client struct {
 }
 
 // IsNew returns 'true' if the contents of 'CLUSTER INFO' match those expected
-// of a node that has never been joined a cluster. 'cluster_state' will be
-// 'fail' as a minumum of 3 nodes is required. 'cluster_known_nodes' will be '1'
-// (self) since it's never been introduced to other nodes. 'cluster_slots_count'
-// and cluster_size' will both be '0' since slots are only assigned as part of
-// the inital clustering or during cluster rebalancing. If any of these fields
-// holds a different value, 'false' is returned.
-func (h *Client) IsNew() (bool, error) {
-	c, err := h.GetClusterInfo()
+// of a node that has never been joined a cluster. See (*ClusterInfo).IsNew.
+func (h *Client) IsNew(ctx context.Context) (bool, error) {
+	c, err := h.GetClusterInfo(ctx)
 	if err != nil {
 		return false, err
 	}
+	return c.IsNew(), nil
+}
 
-	if c.State == "fail" && c.SlotsAssigned == 0 && c.KnownNodes == 1 && c.Size == 0 {
-		return true, nil
-	} else {
-		return false, nil
-	}
+// ClusterInfo is the parsed output of the 'CLUSTER INFO' command.
+type ClusterInfo struct {
+	State                 string `name:"cluster_state" json:"state"`
+	SlotsAssigned         int64  `name:"cluster_slots_assigned" json:"slots-assigned"`
+	SlotsOk               int64  `name:"cluster_slots_ok" json:"slots-ok"`
+	SlotsPfail            int64  `name:"cluster_slots_pfail" json:"slots-pfail"`
+	SlotsFail             int64  `name:"cluster_slots_fail" json:"slots-fail"`
+	KnownNodes            int64  `name:"cluster_known_nodes" json:"known-nodes"`
+	Size                  int64  `name:"cluster_size" json:"size"`
+	CurrentEpoch          int64  `name:"cluster_current_epoch" json:"current-epoch"`
+	MyEpoch               int64  `name:"cluster_my_epoch" json:"my-epoch"`
+	StatsMessagesSent     int64  `name:"cluster_stats_messages_sent" json:"stats-messages-sent"`
+	StatsMessagesReceived int64  `name:"cluster_stats_messages_received" json:"stats-messages-received"`
 }
 
-func (h *Client) GetPrimaryWithLeastReplicas() (string, string, error) {
-	nodes, err := h.getClusterNodes(true, false, false)
-	if err != nil {
-		return "", "", err
-	}
+// IsNew returns 'true' if `c` matches the 'CLUSTER INFO' expected of a node
+// that has never been joined a cluster. 'cluster_state' will be 'fail' as a
+// minumum of 3 nodes is required. 'cluster_known_nodes' will be '1' (self)
+// since it's never been introduced to other nodes. 'cluster_slots_count' and
+// cluster_size' will both be '0' since slots are only assigned as part of the
+// inital clustering or during cluster rebalancing. If any of these fields holds
+// a different value, 'false' is returned.
+func (c *ClusterInfo) IsNew() bool {
+	return c.State == "fail" && c.SlotsAssigned == 0 && c.KnownNodes == 1 && c.Size == 0
+}
 
-	counts := make(map[redisClusterNode]int)
-	for _, n := range nodes {
-		_, ok := counts[n]
-		if !ok {
-			counts[n] = 0
-		}
-		if n.replicaOf != "-" {
-			counts[n] += 1
-		}
-	}
+// ReplicationInfo is the subset of the 'replication' section of 'INFO' that
+// describes the role of a node and the health of its replication links.
+type ReplicationInfo struct {
+	Role                  string `name:"role" json:"role"`
+	ConnectedReplicas     int64  `name:"connected_slaves" json:"connected-replicas"`
+	PrimaryHost           string `name:"master_host" json:"primary-host,omitempty"`
+	PrimaryPort           string `name:"master_port" json:"primary-port,omitempty"`
+	PrimaryLinkStatus     string `name:"master_link_status" json:"primary-link-status,omitempty"`
+	PrimarySyncInProgress int64  `name:"master_sync_in_progress" json:"primary-sync-in-progress"`
+	ReplicaOffset         int64  `name:"slave_repl_offset" json:"replica-offset"`
+	ReplOffset            int64  `name:"master_repl_offset" json:"repl-offset"`
+}
 
-	sortedCounts := make([]redisClusterNode, 0, len(counts))
-	for key := range counts {
-		sortedCounts = append(sortedCounts, key)
-	}
-	sort.Slice(
-		sortedCounts,
-		func(i, j int) bool {
-			return counts[sortedCounts[i]] < counts[sortedCounts[j]]
-		},
-	)
-	return sortedCounts[0].nodeAddr, sortedCounts[0].nodeID, nil
+// MemoryInfo is the subset of the 'memory' section of 'INFO' that describes
+// how close a node is to its memory limit.
+type MemoryInfo struct {
+	UsedMemory int64 `name:"used_memory" json:"used-memory"`
+	MaxMemory  int64 `name:"maxmemory" json:"max-memory"`
 }
 
-func (h *Client) GetPrimaryNodes() ([]redisClusterNode, error) {
-	nodes, err := h.getClusterNodes(true, true, false)
-	if err != nil {
-		return nil, err
-	}
-	return nodes, nil
+// ClientsInfo is the subset of the 'clients' section of 'INFO' that describes
+// how close a node is to its client connection limit. MaxClients is only
+// reported by Redis 7.0 and later, see GetMaxClients for earlier versions.
+type ClientsInfo struct {
+	ConnectedClients int64 `name:"connected_clients" json:"connected-clients"`
+	BlockedClients   int64 `name:"blocked_clients" json:"blocked-clients"`
+	MaxClients       int64 `name:"maxclients" json:"max-clients,omitempty"`
 }
 
-func (h *Client) GetReplicaNodes() ([]redisClusterNode, error) {
-	nodes, err := h.getClusterNodes(true, false, true)
-	if err != nil {
-		return nil, err
-	}
-	return nodes, nil
+// StatsInfo is the subset of the 'stats' section of 'INFO' used by health
+// checks.
+type StatsInfo struct {
+	RejectedConnections int64 `name:"rejected_connections" json:"rejected-connections"`
 }
 
-type clusterInfo struct {
-	State                 string `name:"cluster_state"`
-	SlotsAssigned         int64  `name:"cluster_slots_assigned"`
-	SlotsOk               int64  `name:"cluster_slots_ok"`
-	SlotsPfail            int64  `name:"cluster_slots_pfail"`
-	SlotsFail             int64  `name:"cluster_slots_fail"`
-	KnownNodes            int64  `name:"cluster_known_nodes"`
-	Size                  int64  `name:"cluster_size"`
-	CurrentEpoch          int64  `name:"cluster_current_epoch"`
-	MyEpoch               int64  `name:"cluster_my_epoch"`
-	StatsMessagesSent     int64  `name:"cluster_stats_messages_sent"`
-	StatsMessagesReceived int64  `name:"cluster_stats_messages_received"`
+// PersistenceInfo is the subset of the 'persistence' section of 'INFO' that
+// describes whether a node is loading its dataset and whether its last RDB save
+// and AOF writes succeeded.
+type PersistenceInfo struct {
+	Loading                int64  `name:"loading" json:"loading"`
+	RDBLastBgsaveStatus    string `name:"rdb_last_bgsave_status" json:"rdb-last-bgsave-status"`
+	AOFEnabled             int64  `name:"aof_enabled" json:"aof-enabled"`
+	AOFLastBgrewriteStatus string `name:"aof_last_bgrewrite_status" json:"aof-last-bgrewrite-status"`
+	AOFLastWriteStatus     string `name:"aof_last_write_status" json:"aof-last-write-status"`
 }
 
-func setClusterInfoField(name string, value string, ci *clusterInfo) error {
-	outType := reflect.TypeOf(*ci)
-	outValue := reflect.ValueOf(ci).Elem()
+// setInfoField sets the field of the struct pointed to by `out` with a 'name'
+// tag of `name` to `value`. Unknown names are ignored.
+func setInfoField(name string, value string, out interface{}) error {
+	outValue := reflect.ValueOf(out).Elem()
+	outType := outValue.Type()
 	for i := 0; i < outType.NumField(); i++ {
 		field := outType.Field(i)
 		fieldValue := outValue.Field(i)
@@ -135,104 +135,151 @@ func setClusterInfoField(name string, value string, ci *clusterInfo) error {
 	return nil
 }
 
-// unmarshalClusterInfo constructs a *clusterInfo by parsing the (INFO style) output
-// of the 'cluster info' command as specified in:
-// https://redis.io/commands/cluster-info.
-func unmarshalClusterInfo(info string) (*clusterInfo, error) {
-	var c clusterInfo
+// unmarshalInfo parses INFO style output, as specified in
+// https://redis.io/commands/info#return-value, into the struct pointed to by
+// `out`.
+func unmarshalInfo(info string, out interface{}) error {
 	for _, line := range strings.Split(info, "\r\n") {
-		// https://redis.io/commands/info#return-value
 		if strings.HasPrefix(line, "#") || line == "" {
 			continue
 		}
 		kv := strings.SplitN(line, ":", 2)
-		err := setClusterInfoField(kv[0], kv[1], &c)
+		if len(kv) != 2 {
+			return fmt.Errorf("line %q is not a 'name:value' pair", line)
+		}
+		err := setInfoField(kv[0], kv[1], out)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse 'cluster info': %w", err)
+			return err
 		}
 	}
+	return nil
+}
+
+// unmarshalClusterInfo constructs a *ClusterInfo by parsing the (INFO style) output
+// of the 'cluster info' command as specified in:
+// https://redis.io/commands/cluster-info.
+func unmarshalClusterInfo(info string) (*ClusterInfo, error) {
+	var c ClusterInfo
+	err := unmarshalInfo(info, &c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse 'cluster info': %w", err)
+	}
 	return &c, nil
 }
 
-func (h *Client) GetClusterInfo() (*clusterInfo, error) {
-	info, err := h.Client.ClusterInfo(context.Background()).Result()
+// unmarshalReplicationInfo constructs a *ReplicationInfo by parsing the output
+// of the 'info replication' command.
+func unmarshalReplicationInfo(info string) (*ReplicationInfo, error) {
+	var r ReplicationInfo
+	err := unmarshalInfo(info, &r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse 'info replication': %w", err)
+	}
+	return &r, nil
+}
+
+func (h *Client) GetClusterInfo(ctx context.Context) (*ClusterInfo, error) {
+	info, err := h.Client.ClusterInfo(ctx).Result()
 	if err != nil {
 		return nil, err
 	}
 	return unmarshalClusterInfo(info)
 }
 
-type redisClusterNode struct {
-	nodeID     string
-	nodeAddr   string
-	role       string
-	replicaOf  string
-	connection string
+// GetReplicationInfo returns the role of this node and the health of its
+// replication links from the output of 'INFO replication'.
+func (h *Client) GetReplicationInfo(ctx context.Context) (*ReplicationInfo, error) {
+	info, err := h.Client.Info(ctx, "replication").Result()
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalReplicationInfo(info)
 }
 
-func parseClusterNodesResult(connectedOnly, primaryOnly, replicaOnly bool, result string) ([]redisClusterNode, error) {
-	// Remove the slots column to make the number of values per row equal and
-	// avoid ignoring all `csv.ErrFieldCount`.
-	output := strings.Split(result, "\n")
-	for i, line := range output {
-		output[i] = strings.SplitAfter(line, "connected")[0]
+// getInfo parses the output of 'INFO <section>' into the struct pointed to by
+// `out`.
+func (h *Client) getInfo(ctx context.Context, section string, out interface{}) error {
+	info, err := h.Client.Info(ctx, section).Result()
+	if err != nil {
+		return err
 	}
-	result = strings.Join(output, "\n")
-
-	// Replacing myself,<role> to make `role` more consistent.
-	result = strings.ReplaceAll(result, "myself,master", "master")
-	result = strings.ReplaceAll(result, "myself,slave", "slave")
-	result = strings.ReplaceAll(result, "master,fail", "master")
-	result = strings.ReplaceAll(result, "slave,fail", "slave")
-
-	var nodes []redisClusterNode
-	reader := csv.NewReader(strings.NewReader(result))
-	reader.Comma = ' '
-	for {
-		record, err := reader.Read()
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, err
-		}
+	err = unmarshalInfo(info, out)
+	if err != nil {
+		return fmt.Errorf("failed to parse 'info %s': %w", section, err)
+	}
+	return nil
+}
 
-		if connectedOnly {
-			if record[7] == "disconnected" {
-				continue
-			}
-		}
+// GetMemoryInfo returns the memory used by this node and its limit from the
+// output of 'INFO memory'.
+func (h *Client) GetMemoryInfo(ctx context.Context) (*MemoryInfo, error) {
+	var m MemoryInfo
+	err := h.getInfo(ctx, "memory", &m)
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
 
-		if primaryOnly {
-			if record[2] == "slave" {
-				continue
-			}
-		}
+// GetClientsInfo returns the clients connected to this node and its limit from
+// the output of 'INFO clients'.
+func (h *Client) GetClientsInfo(ctx context.Context) (*ClientsInfo, error) {
+	var c ClientsInfo
+	err := h.getInfo(ctx, "clients", &c)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
 
-		if replicaOnly {
-			if record[2] == "master" {
-				continue
-			}
-		}
+// GetMaxClients returns the client connection limit of this node from the
+// output of 'CONFIG GET maxclients', for Redis versions before 7.0 that don't
+// report it in 'INFO clients'.
+func (h *Client) GetMaxClients(ctx context.Context) (int64, error) {
+	config, err := h.Client.ConfigGet(ctx, "maxclients").Result()
+	if err != nil {
+		return 0, err
+	}
+	return parseMaxClients(config)
+}
 
-		nodes = append(
-			nodes,
-			redisClusterNode{record[0], record[1], record[2], record[3], record[7]},
-		)
+// parseMaxClients parses the 'maxclients' value from the name/value pairs
+// returned by 'CONFIG GET maxclients'.
+func parseMaxClients(config []interface{}) (int64, error) {
+	if len(config) != 2 || config[0] != "maxclients" {
+		return 0, fmt.Errorf("unexpected reply %q to 'CONFIG GET maxclients'", config)
+	}
+	value, ok := config[1].(string)
+	if !ok {
+		return 0, fmt.Errorf("unexpected value %q of maxclients", config[1])
+	}
+	maxClients, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't parse %q, value of maxclients, as int: %w", value, err)
 	}
+	return maxClients, nil
+}
 
-	if len(nodes) == 0 && !replicaOnly {
-		return nil, errors.New("no primary nodes found in 'cluster nodes' output")
+// GetStatsInfo returns the output of 'INFO stats'.
+func (h *Client) GetStatsInfo(ctx context.Context) (*StatsInfo, error) {
+	var s StatsInfo
+	err := h.getInfo(ctx, "stats", &s)
+	if err != nil {
+		return nil, err
 	}
-	return nodes, nil
+	return &s, nil
 }
 
-func (h *Client) getClusterNodes(connectedOnly, primaryOnly, replicaOnly bool) ([]redisClusterNode, error) {
-	result, err := h.Client.ClusterNodes(context.Background()).Result()
+// GetPersistenceInfo returns whether this node is loading its dataset and the
+// status of its last RDB save and AOF writes from the output of 'INFO
+// persistence'.
+func (h *Client) GetPersistenceInfo(ctx context.Context) (*PersistenceInfo, error) {
+	var p PersistenceInfo
+	err := h.getInfo(ctx, "persistence", &p)
 	if err != nil {
 		return nil, err
 	}
-	return parseClusterNodesResult(connectedOnly, primaryOnly, replicaOnly, result)
+	return &p, nil
 }
 
 func New(conf config.RedisOpts) (*Client, error) {
@@ -5,205 +5,158 @@ import (
 	"testing"
 )
 
-func Test_parseClusterNodesResult(t *testing.T) {
+func Test_unmarshalClusterInfo(t *testing.T) {
 	type args struct {
-		connectedOnly bool
-		primaryOnly   bool
-		replicaOnly   bool
-		result        string
+		result string
 	}
 	tests := []struct {
 		args    args
-		want    []redisClusterNode
+		want    *ClusterInfo
 		wantErr bool
 	}{
 		{
-			args{
-				connectedOnly: true,
-				primaryOnly:   false,
-				replicaOnly:   false,
-				result:        "237c7223aa3bfae4d0b9ac2c7e1990c46b33ee73 127.0.0.1:31264@41264 myself,slave 59e29b0b4fc1c6f5f2c2698ffdda28cd00f77510 0 1637115996000 7 connected",
-			},
-			[]redisClusterNode{
-				{
-					"237c7223aa3bfae4d0b9ac2c7e1990c46b33ee73",
-					"127.0.0.1:31264@41264",
-					"slave",
-					"59e29b0b4fc1c6f5f2c2698ffdda28cd00f77510",
-					"connected",
-				},
-			},
-			false,
-		},
-		{
-			args{
-				connectedOnly: false,
-				primaryOnly:   false,
-				replicaOnly:   false,
-				result:        "58ee2b950353f1ba209a7cbe016d424550265312 127.0.0.1:27356@37356 master,fail - 1637115881821 0 0 disconnected",
-			},
-			[]redisClusterNode{
-				{
-					"58ee2b950353f1ba209a7cbe016d424550265312",
-					"127.0.0.1:27356@37356",
-					"master",
-					"-",
-					"disconnected",
-				},
+			args{"cluster_state:ok\r\ncluster_slots_assigned:16384\r\ncluster_slots_ok:16384\r\ncluster_slots_pfail:0\r\ncluster_slots_fail:0\r\ncluster_known_nodes:13\r\ncluster_size:3\r\ncluster_current_epoch:10\r\ncluster_my_epoch:7\r\ncluster_stats_messages_ping_sent:88\r\ncluster_stats_messages_pong_sent:63\r\ncluster_stats_messages_meet_sent:1\r\ncluster_stats_messages_sent:152\r\ncluster_stats_messages_ping_received:63\r\ncluster_stats_messages_pong_received:82\r\ncluster_stats_messages_received:145\r\n"},
+			&ClusterInfo{
+				State:                 "ok",
+				SlotsAssigned:         16384,
+				SlotsOk:               16384,
+				SlotsPfail:            0,
+				SlotsFail:             0,
+				KnownNodes:            13,
+				Size:                  3,
+				CurrentEpoch:          10,
+				MyEpoch:               7,
+				StatsMessagesSent:     152,
+				StatsMessagesReceived: 145,
 			},
 			false,
 		},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			got, err := unmarshalClusterInfo(tt.args.result)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("unmarshalClusterInfo() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unmarshalClusterInfo() = %+v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_unmarshalReplicationInfo(t *testing.T) {
+	tests := []struct {
+		name    string
+		result  string
+		want    *ReplicationInfo
+		wantErr bool
+	}{
 		{
-			args{
-				connectedOnly: true,
-				primaryOnly:   false,
-				replicaOnly:   false,
-				result:        "fb41fa1d1f85a33be723fa2e553cd78bd6846017 127.0.0.1:28216@38216 master - 0 1637116000822 0 connected",
-			},
-			[]redisClusterNode{
-				{
-					"fb41fa1d1f85a33be723fa2e553cd78bd6846017",
-					"127.0.0.1:28216@38216",
-					"master",
-					"-",
-					"connected",
-				},
-			},
+			"primary",
+			"# Replication\r\nrole:master\r\nconnected_slaves:2\r\nslave0:ip=10.0.0.2,port=6379,state=online,offset=350,lag=0\r\nslave1:ip=10.0.0.3,port=6379,state=online,offset=350,lag=1\r\nmaster_repl_offset:350\r\n",
+			&ReplicationInfo{Role: "master", ConnectedReplicas: 2, ReplOffset: 350},
 			false,
 		},
 		{
-			args{
-				connectedOnly: true,
-				primaryOnly:   true,
-				replicaOnly:   false,
-				result:        "59e29b0b4fc1c6f5f2c2698ffdda28cd00f77510 127.0.0.1:28999@38999 master - 0 1637116000000 7 connected 0-5460",
-			},
-			[]redisClusterNode{
-				{
-					"59e29b0b4fc1c6f5f2c2698ffdda28cd00f77510",
-					"127.0.0.1:28999@38999",
-					"master",
-					"-",
-					"connected",
-				},
-			},
+			"replica",
+			"# Replication\r\nrole:slave\r\nmaster_host:10.0.0.1\r\nmaster_port:6379\r\nmaster_link_status:up\r\nmaster_sync_in_progress:0\r\nslave_repl_offset:340\r\nconnected_slaves:0\r\nmaster_repl_offset:340\r\n",
+			&ReplicationInfo{Role: "slave", PrimaryHost: "10.0.0.1", PrimaryPort: "6379", PrimaryLinkStatus: "up", ReplicaOffset: 340, ReplOffset: 340},
 			false,
 		},
 		{
-			args{
-				connectedOnly: true,
-				primaryOnly:   false,
-				replicaOnly:   false,
-				result:        "57d589837c2f39e0959ee49c5dd3f0ed09da0b20 127.0.0.1:20449@30449 master,fail - 1637115880786 0 0 disconnected",
-			},
+			"malformed",
+			"# Replication\r\nrole\r\n",
 			nil,
 			true,
 		},
-		{
-			args{
-				connectedOnly: false,
-				primaryOnly:   false,
-				replicaOnly:   true,
-				result:        "a9b3c447fcf74ef7e49756fa35b13dbf03a3fd16 127.0.0.1:26437@36437 slave,fail - 1637115881821 0 0 disconnected",
-			},
-			[]redisClusterNode{
-				{
-					"a9b3c447fcf74ef7e49756fa35b13dbf03a3fd16",
-					"127.0.0.1:26437@36437",
-					"slave",
-					"-",
-					"disconnected",
-				},
-			},
-			false,
-		},
-		{
-			args{
-				connectedOnly: true,
-				primaryOnly:   false,
-				replicaOnly:   false,
-				result:        "a7b72b6332f6890c195e4c4504b538480b964a0c 127.0.0.1:28896@38896 slave 2688d5779f45312a39ab2ce7aaa777839097c993 0 1637116003936 8 connected",
-			},
-			[]redisClusterNode{
-				{
-					"a7b72b6332f6890c195e4c4504b538480b964a0c",
-					"127.0.0.1:28896@38896",
-					"slave",
-					"2688d5779f45312a39ab2ce7aaa777839097c993",
-					"connected",
-				},
-			},
-			false,
-		},
-		{
-			args{
-				connectedOnly: false,
-				primaryOnly:   false,
-				replicaOnly:   false,
-				result:        "59ec374a0f482e2959d669065e6ac137d94a5df1 127.0.0.1:28395@38395 master,fail - 1637115881821 0 0 disconnected",
-			},
-			[]redisClusterNode{
-				{
-					"59ec374a0f482e2959d669065e6ac137d94a5df1",
-					"127.0.0.1:28395@38395",
-					"master",
-					"-",
-					"disconnected",
-				},
-			},
-			false,
-		},
 	}
 	for _, tt := range tests {
-		t.Run("", func(t *testing.T) {
-			got, err := parseClusterNodesResult(tt.args.connectedOnly, tt.args.primaryOnly, tt.args.replicaOnly, tt.args.result)
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := unmarshalReplicationInfo(tt.result)
 			if (err != nil) != tt.wantErr {
-				t.Errorf("parseClusterNodesResult() error = %v, wantErr %v", err, tt.wantErr)
-				return
+				t.Fatalf("unmarshalReplicationInfo() error = %v, wantErr %v", err, tt.wantErr)
 			}
 			if !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("parseClusterNodesResult() = %v, want %v", got, tt.want)
+				t.Errorf("unmarshalReplicationInfo() = %+v, want %+v", got, tt.want)
 			}
 		})
 	}
 }
 
-func Test_unmarshalClusterInfo(t *testing.T) {
-	type args struct {
-		result string
+func TestClusterInfo_IsNew(t *testing.T) {
+	tests := []struct {
+		name string
+		info ClusterInfo
+		want bool
+	}{
+		{"new node", ClusterInfo{State: "fail", KnownNodes: 1}, true},
+		{"introduced to another node", ClusterInfo{State: "fail", KnownNodes: 2}, false},
+		{"assigned slots", ClusterInfo{State: "fail", SlotsAssigned: 16384, KnownNodes: 1, Size: 1}, false},
+		{"joined", ClusterInfo{State: "ok", SlotsAssigned: 16384, KnownNodes: 6, Size: 3}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.info.IsNew(); got != tt.want {
+				t.Errorf("IsNew() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_unmarshalInfo(t *testing.T) {
+	var memory MemoryInfo
+	err := unmarshalInfo("# Memory\r\nused_memory:1048576\r\nused_memory_human:1.00M\r\nmaxmemory:4194304\r\nmaxmemory_policy:noeviction\r\n", &memory)
+	if err != nil {
+		t.Fatalf("unmarshalInfo() error = %v", err)
+	}
+	wantMemory := MemoryInfo{UsedMemory: 1048576, MaxMemory: 4194304}
+	if memory != wantMemory {
+		t.Errorf("unmarshalInfo() = %+v, want %+v", memory, wantMemory)
+	}
+
+	var clients ClientsInfo
+	err = unmarshalInfo("# Clients\r\nconnected_clients:12\r\ncluster_connections:10\r\nmaxclients:10000\r\nblocked_clients:1\r\n", &clients)
+	if err != nil {
+		t.Fatalf("unmarshalInfo() error = %v", err)
+	}
+	wantClients := ClientsInfo{ConnectedClients: 12, BlockedClients: 1, MaxClients: 10000}
+	if clients != wantClients {
+		t.Errorf("unmarshalInfo() = %+v, want %+v", clients, wantClients)
+	}
+
+	var persistence PersistenceInfo
+	err = unmarshalInfo("# Persistence\r\nloading:1\r\nasync_loading:0\r\nrdb_last_bgsave_status:err\r\naof_enabled:1\r\naof_last_bgrewrite_status:ok\r\naof_last_write_status:ok\r\n", &persistence)
+	if err != nil {
+		t.Fatalf("unmarshalInfo() error = %v", err)
 	}
+	wantPersistence := PersistenceInfo{Loading: 1, RDBLastBgsaveStatus: "err", AOFEnabled: 1, AOFLastBgrewriteStatus: "ok", AOFLastWriteStatus: "ok"}
+	if persistence != wantPersistence {
+		t.Errorf("unmarshalInfo() = %+v, want %+v", persistence, wantPersistence)
+	}
+}
+
+func Test_parseMaxClients(t *testing.T) {
 	tests := []struct {
-		args    args
-		want    *clusterInfo
+		name    string
+		config  []interface{}
+		want    int64
 		wantErr bool
 	}{
-		{
-			args{"cluster_state:ok\r\ncluster_slots_assigned:16384\r\ncluster_slots_ok:16384\r\ncluster_slots_pfail:0\r\ncluster_slots_fail:0\r\ncluster_known_nodes:13\r\ncluster_size:3\r\ncluster_current_epoch:10\r\ncluster_my_epoch:7\r\ncluster_stats_messages_ping_sent:88\r\ncluster_stats_messages_pong_sent:63\r\ncluster_stats_messages_meet_sent:1\r\ncluster_stats_messages_sent:152\r\ncluster_stats_messages_ping_received:63\r\ncluster_stats_messages_pong_received:82\r\ncluster_stats_messages_received:145\r\n"},
-			&clusterInfo{
-				State:                 "ok",
-				SlotsAssigned:         16384,
-				SlotsOk:               16384,
-				SlotsPfail:            0,
-				SlotsFail:             0,
-				KnownNodes:            13,
-				Size:                  3,
-				CurrentEpoch:          10,
-				MyEpoch:               7,
-				StatsMessagesSent:     152,
-				StatsMessagesReceived: 145,
-			},
-			false,
-		},
+		{"maxclients", []interface{}{"maxclients", "10000"}, 10000, false},
+		{"empty reply", []interface{}{}, 0, true},
+		{"other parameter", []interface{}{"maxmemory", "0"}, 0, true},
+		{"not an int", []interface{}{"maxclients", "lots"}, 0, true},
 	}
 	for _, tt := range tests {
-		t.Run("", func(t *testing.T) {
-			got, err := unmarshalClusterInfo(tt.args.result)
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseMaxClients(tt.config)
 			if (err != nil) != tt.wantErr {
-				t.Errorf("unmarshalClusterInfo() error = %v, wantErr %v", err, tt.wantErr)
-				return
+				t.Fatalf("parseMaxClients() error = %v, wantErr %v", err, tt.wantErr)
 			}
-			if !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("unmarshalClusterInfo() = %+v, want %v", got, tt.want)
+			if got != tt.want {
+				t.Errorf("parseMaxClients() = %d, want %d", got, tt.want)
 			}
 		})
 	}
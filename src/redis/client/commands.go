@@ -0,0 +1,92 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// GetNodeID returns the ID of this node.
+func (h *Client) GetNodeID(ctx context.Context) (string, error) {
+	return h.Client.Do(ctx, "cluster", "myid").Text()
+}
+
+// Meet introduces this node to the node at `nodeAddr`. Both nodes will learn
+// about the rest of each other's cluster via gossip.
+func (h *Client) Meet(ctx context.Context, nodeAddr string) error {
+	host, port, err := net.SplitHostPort(nodeAddr)
+	if err != nil {
+		return fmt.Errorf("cannot parse node address %q: %w", nodeAddr, err)
+	}
+	return h.Client.ClusterMeet(ctx, host, port).Err()
+}
+
+// AddSlots assigns the shard slots in `slots` to this node.
+func (h *Client) AddSlots(ctx context.Context, slots SlotRange) error {
+	return h.Client.ClusterAddSlotsRange(ctx, slots.Start, slots.End).Err()
+}
+
+// DelSlots unassigns the shard slots in `slots` in this node's view of the
+// cluster.
+func (h *Client) DelSlots(ctx context.Context, slots SlotRange) error {
+	return h.Client.ClusterDelSlotsRange(ctx, slots.Start, slots.End).Err()
+}
+
+// BumpEpoch increments the config epoch of this node, if necessary, so that
+// its claims on shard slots take precedence over those of every other node.
+func (h *Client) BumpEpoch(ctx context.Context) error {
+	return h.Client.Do(ctx, "cluster", "bumpepoch").Err()
+}
+
+// SetConfigEpoch sets the config epoch of this node. This is only permitted on
+// a node that has never joined a cluster.
+func (h *Client) SetConfigEpoch(ctx context.Context, epoch int64) error {
+	return h.Client.Do(ctx, "cluster", "set-config-epoch", epoch).Err()
+}
+
+// SetSlot performs 'CLUSTER SETSLOT <slot> <subcommand> <nodeID>' on this
+// node, where `subcommand` is one of 'importing', 'migrating' or 'node'.
+func (h *Client) SetSlot(ctx context.Context, slot int, subcommand string, nodeID string) error {
+	return h.Client.Do(ctx, "cluster", "setslot", slot, subcommand, nodeID).Err()
+}
+
+// GetKeysInSlot returns up to `count` keys from shard slot `slot` of this node.
+func (h *Client) GetKeysInSlot(ctx context.Context, slot int, count int) ([]string, error) {
+	return h.Client.ClusterGetKeysInSlot(ctx, slot, count).Result()
+}
+
+// Migrate atomically moves `keys` from this node to the node at `nodeAddr`.
+// The credentials this client was created with are used to authenticate with
+// the destination node.
+func (h *Client) Migrate(ctx context.Context, nodeAddr string, keys []string, timeout time.Duration) error {
+	host, port, err := net.SplitHostPort(nodeAddr)
+	if err != nil {
+		return fmt.Errorf("cannot parse node address %q: %w", nodeAddr, err)
+	}
+
+	opts := h.Client.Options()
+	args := []interface{}{"migrate", host, port, "", 0, timeout.Milliseconds(), "auth2", opts.Username, opts.Password, "keys"}
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	return h.Client.Do(ctx, args...).Err()
+}
+
+// Forget instructs this node to remove the node with ID `nodeID` from its node
+// table. The node is banned from being re-added via gossip for 60 seconds.
+func (h *Client) Forget(ctx context.Context, nodeID string) error {
+	return h.Client.ClusterForget(ctx, nodeID).Err()
+}
+
+// Replicate reconfigures this node as a replica of the shard primary with ID
+// `primaryID`.
+func (h *Client) Replicate(ctx context.Context, primaryID string) error {
+	return h.Client.ClusterReplicate(ctx, primaryID).Err()
+}
+
+// Reset performs a soft 'CLUSTER RESET' on this node. All other nodes are
+// forgotten and, if the node is a replica, it's turned into an empty primary.
+func (h *Client) Reset(ctx context.Context) error {
+	return h.Client.ClusterResetSoft(ctx).Err()
+}
@@ -0,0 +1,343 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SlotRange is an inclusive range of Redis Cluster shard slots.
+type SlotRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// Count returns the number of shard slots in the range.
+func (r SlotRange) Count() int {
+	return r.End - r.Start + 1
+}
+
+// ClusterNode is a single node entry from the output of 'CLUSTER NODES' as
+// specified in: https://redis.io/commands/cluster-nodes.
+type ClusterNode struct {
+	// ID is the 40 character node ID.
+	ID string
+
+	// Addr is the <ip>:<port> that clients use to reach the node. The cluster
+	// bus port and hostname, if present, are not included.
+	Addr string
+
+	// Flags is the list of flags reported for the node (e.g. 'myself',
+	// 'master', 'slave', 'fail?', 'fail', 'noaddr').
+	Flags []string
+
+	// PrimaryID is the ID of the shard primary this node replicates. It's
+	// empty when the node is a primary.
+	PrimaryID string
+
+	// LinkState is either 'connected' or 'disconnected'.
+	LinkState string
+
+	// Slots contains the shard slot ranges served by the node.
+	Slots []SlotRange
+
+	// Migrating maps each shard slot that the node is migrating to the ID of
+	// the node it's being migrated to. Redis only reports this for the node
+	// flagged 'myself'.
+	Migrating map[int]string
+
+	// Importing maps each shard slot that the node is importing to the ID of
+	// the node it's being imported from. Redis only reports this for the node
+	// flagged 'myself'.
+	Importing map[int]string
+}
+
+// hasFlag returns true if `flag` is present in `n.Flags`.
+func (n ClusterNode) hasFlag(flag string) bool {
+	for _, f := range n.Flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// IsPrimary returns true if the node is a shard primary.
+func (n ClusterNode) IsPrimary() bool {
+	return n.hasFlag("master")
+}
+
+// IsReplica returns true if the node is a shard replica.
+func (n ClusterNode) IsReplica() bool {
+	return n.hasFlag("slave")
+}
+
+// IsMyself returns true if the node is the node that 'CLUSTER NODES' was
+// requested from.
+func (n ClusterNode) IsMyself() bool {
+	return n.hasFlag("myself")
+}
+
+// InHandshake returns true if the node is still being introduced to the
+// cluster and hasn't been assigned its final node ID yet.
+func (n ClusterNode) InHandshake() bool {
+	return n.hasFlag("handshake")
+}
+
+// IsFailing returns true if the node has been flagged as failing or has no
+// known address.
+func (n ClusterNode) IsFailing() bool {
+	return n.hasFlag("fail") || n.hasFlag("fail?") || n.hasFlag("noaddr")
+}
+
+// HasFailed returns true if the cluster has agreed that the node has failed or
+// the node has no known address. Unlike IsFailing, nodes that are only
+// suspected of failing by this node ('fail?') are not included.
+func (n ClusterNode) HasFailed() bool {
+	return n.hasFlag("fail") || n.hasFlag("noaddr")
+}
+
+// IsConnected returns true if the cluster bus link to the node is up.
+func (n ClusterNode) IsConnected() bool {
+	return n.LinkState == "connected"
+}
+
+// SlotCount returns the total number of shard slots served by the node.
+func (n ClusterNode) SlotCount() int {
+	var count int
+	for _, r := range n.Slots {
+		count += r.Count()
+	}
+	return count
+}
+
+// ServesSlot returns true if `slot` is in one of the node's shard slot ranges.
+func (n ClusterNode) ServesSlot(slot int) bool {
+	for _, r := range n.Slots {
+		if slot >= r.Start && slot <= r.End {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSlotRange parses a single slot column value from 'CLUSTER NODES' (e.g.
+// '0-5460' or '5461').
+func parseSlotRange(value string) (SlotRange, error) {
+	bounds := strings.SplitN(value, "-", 2)
+	start, err := strconv.Atoi(bounds[0])
+	if err != nil {
+		return SlotRange{}, fmt.Errorf("couldn't parse slot range %q: %w", value, err)
+	}
+	if len(bounds) == 1 {
+		return SlotRange{start, start}, nil
+	}
+	end, err := strconv.Atoi(bounds[1])
+	if err != nil {
+		return SlotRange{}, fmt.Errorf("couldn't parse slot range %q: %w", value, err)
+	}
+	return SlotRange{start, end}, nil
+}
+
+// parseOpenSlot parses a shard slot being migrated, formatted as
+// '[<slot>->-<node-id>]', or imported, formatted as '[<slot>-<-<node-id>]', and
+// adds it to `n.Migrating` or `n.Importing`.
+func (n *ClusterNode) parseOpenSlot(s string) error {
+	trimmed := strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	for _, sep := range []string{"->-", "-<-"} {
+		parts := strings.SplitN(trimmed, sep, 2)
+		if len(parts) != 2 {
+			continue
+		}
+		slot, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return fmt.Errorf("couldn't parse open slot %q: %w", s, err)
+		}
+
+		if sep == "->-" {
+			if n.Migrating == nil {
+				n.Migrating = make(map[int]string)
+			}
+			n.Migrating[slot] = parts[1]
+		} else {
+			if n.Importing == nil {
+				n.Importing = make(map[int]string)
+			}
+			n.Importing[slot] = parts[1]
+		}
+		return nil
+	}
+	return fmt.Errorf("couldn't parse open slot %q", s)
+}
+
+// parseClusterNodes constructs a []ClusterNode by parsing the output of the
+// 'cluster nodes' command.
+func parseClusterNodes(result string) ([]ClusterNode, error) {
+	var nodes []ClusterNode
+	for _, line := range strings.Split(result, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 8 {
+			return nil, fmt.Errorf("failed to parse 'cluster nodes' line %q: expected at least 8 fields", line)
+		}
+
+		node := ClusterNode{
+			ID:        fields[0],
+			Addr:      strings.SplitN(strings.SplitN(fields[1], "@", 2)[0], ",", 2)[0],
+			Flags:     strings.Split(fields[2], ","),
+			LinkState: fields[7],
+		}
+		if fields[3] != "-" {
+			node.PrimaryID = fields[3]
+		}
+
+		for _, slot := range fields[8:] {
+			// Slots being imported or migrated are formatted as
+			// '[<slot>->-<node-id>]' or '[<slot>-<-<node-id>]'.
+			if strings.HasPrefix(slot, "[") {
+				err := node.parseOpenSlot(slot)
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse 'cluster nodes': %w", err)
+				}
+				continue
+			}
+			slotRange, err := parseSlotRange(slot)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse 'cluster nodes': %w", err)
+			}
+			node.Slots = append(node.Slots, slotRange)
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// GetClusterNodes returns every node known to this node, including itself.
+func (h *Client) GetClusterNodes(ctx context.Context) ([]ClusterNode, error) {
+	result, err := h.Client.ClusterNodes(ctx).Result()
+	if err != nil {
+		return nil, err
+	}
+	return parseClusterNodes(result)
+}
+
+// countReplicas returns a map of shard primary IDs to the count of connected
+// and healthy replicas that each has in `nodes`.
+func countReplicas(nodes []ClusterNode) map[string]int {
+	counts := make(map[string]int)
+	for _, n := range nodes {
+		if n.IsReplica() && n.PrimaryID != "" && n.IsConnected() && !n.IsFailing() {
+			counts[n.PrimaryID]++
+		}
+	}
+	return counts
+}
+
+// PrimaryToRemove selects the shard primary in `nodes` that should be removed
+// when scaling in. The connected primary serving the fewest shard slots is
+// selected, as it has the least data to migrate. Ties are broken by node ID so
+// that every node makes the same selection.
+func PrimaryToRemove(nodes []ClusterNode) (ClusterNode, error) {
+	var candidates []ClusterNode
+	for _, n := range nodes {
+		if n.IsPrimary() && n.IsConnected() && !n.IsFailing() {
+			candidates = append(candidates, n)
+		}
+	}
+	if len(candidates) == 0 {
+		return ClusterNode{}, errors.New("no connected primary nodes found in 'cluster nodes' output")
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].SlotCount() != candidates[j].SlotCount() {
+			return candidates[i].SlotCount() < candidates[j].SlotCount()
+		}
+		return candidates[i].ID < candidates[j].ID
+	})
+	return candidates[0], nil
+}
+
+// ReplicasOf returns the replicas in `nodes` of the shard primary with ID
+// `primaryID`.
+func ReplicasOf(nodes []ClusterNode, primaryID string) []ClusterNode {
+	var replicas []ClusterNode
+	for _, n := range nodes {
+		if n.IsReplica() && n.PrimaryID == primaryID {
+			replicas = append(replicas, n)
+		}
+	}
+	return replicas
+}
+
+// PrimaryForReplica selects the shard primary in `nodes` that a new replica, or
+// a replica being moved off of the primary with ID `excludeID`, should
+// replicate. Only primaries that are connected, not failing, and serve shard
+// slots are considered. Replicas are counted against the primary they
+// replicate, so orphaned primaries (those without a healthy replica) are
+// selected first, then the primary with the fewest replicas. Ties are broken by
+// node ID so that every node makes the same selection.
+func PrimaryForReplica(nodes []ClusterNode, excludeID string) (ClusterNode, error) {
+	var candidates []ClusterNode
+	for _, n := range nodes {
+		if n.ID == excludeID {
+			continue
+		}
+		if n.IsPrimary() && n.IsConnected() && !n.IsFailing() && n.SlotCount() > 0 {
+			candidates = append(candidates, n)
+		}
+	}
+	if len(candidates) == 0 {
+		return ClusterNode{}, errors.New("no connected primary nodes serving shard slots found in 'cluster nodes' output")
+	}
+
+	counts := countReplicas(nodes)
+	sort.Slice(candidates, func(i, j int) bool {
+		if counts[candidates[i].ID] != counts[candidates[j].ID] {
+			return counts[candidates[i].ID] < counts[candidates[j].ID]
+		}
+		return candidates[i].ID < candidates[j].ID
+	})
+	return candidates[0], nil
+}
+
+// ReplicaToRemove selects the replica in `nodes` that should be removed when
+// scaling in. Replicas that are failing or disconnected, such as those whose
+// allocation was stopped, are always selected first. Otherwise a replica of
+// the primary with the most replicas is selected, which leaves the best
+// distribution of replicas per primary. Ties are broken by node ID so that
+// every node makes the same selection.
+func ReplicaToRemove(nodes []ClusterNode) (ClusterNode, error) {
+	var candidates []ClusterNode
+	for _, n := range nodes {
+		if n.IsReplica() {
+			candidates = append(candidates, n)
+		}
+	}
+	if len(candidates) == 0 {
+		return ClusterNode{}, errors.New("no replica nodes found in 'cluster nodes' output")
+	}
+
+	healthy := func(n ClusterNode) bool {
+		return n.IsConnected() && !n.IsFailing()
+	}
+	counts := countReplicas(nodes)
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if healthy(a) != healthy(b) {
+			return !healthy(a)
+		}
+		if counts[a.PrimaryID] != counts[b.PrimaryID] {
+			return counts[a.PrimaryID] > counts[b.PrimaryID]
+		}
+		if a.PrimaryID != b.PrimaryID {
+			return a.PrimaryID < b.PrimaryID
+		}
+		return a.ID < b.ID
+	})
+	return candidates[0], nil
+}
@@ -0,0 +1,257 @@
+package client
+
+import (
+	"reflect"
+	"testing"
+)
+
+// clusterNodesFixture is the output of 'cluster nodes' for a cluster with four
+// shard primaries, one of which has been drained of shard slots, and three
+// replicas.
+const clusterNodesFixture = `07c37dfeb235213a872192d90877d0cd55635b91 127.0.0.1:30004@31004 slave e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 0 1426238317239 4 connected
+67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1 127.0.0.1:30002@31002 master - 0 1426238316232 2 connected 5461-10922
+292f8b365bb7edb5e285caf0b7e6ddc7265d2f4f 127.0.0.1:30003@31003 master - 0 1426238318243 3 connected 10923-16383
+6ec23923021cf3ffec47632106199cb7f496ce01 127.0.0.1:30005@31005 slave 67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1 0 1426238316232 5 connected
+824fe116063bc5fcf9f4ffd895bc17aee7731ac3 127.0.0.1:30006@31006 slave 67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1 0 1426238317741 6 connected
+e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 127.0.0.1:30001@31001 myself,master - 0 0 1 connected 0-5460
+d289c575dcbc4bdd2931585fd4339089e461a27d 127.0.0.1:30007@31007 master - 0 1426238318243 7 connected
+`
+
+func Test_parseClusterNodes(t *testing.T) {
+	tests := []struct {
+		result  string
+		want    []ClusterNode
+		wantErr bool
+	}{
+		{
+			"e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 127.0.0.1:30001@31001 myself,master - 0 0 1 connected 0-5460 5462 [5461->-67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1]\n",
+			[]ClusterNode{
+				{
+					ID:        "e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca",
+					Addr:      "127.0.0.1:30001",
+					Flags:     []string{"myself", "master"},
+					LinkState: "connected",
+					Slots:     []SlotRange{{0, 5460}, {5462, 5462}},
+					Migrating: map[int]string{5461: "67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1"},
+				},
+			},
+			false,
+		},
+		{
+			"67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1 127.0.0.1:30002@31002 myself,master - 0 0 2 connected 5463-10922 [5461-<-e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca]\n",
+			[]ClusterNode{
+				{
+					ID:        "67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1",
+					Addr:      "127.0.0.1:30002",
+					Flags:     []string{"myself", "master"},
+					LinkState: "connected",
+					Slots:     []SlotRange{{5463, 10922}},
+					Importing: map[int]string{5461: "e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca"},
+				},
+			},
+			false,
+		},
+		{
+			"a9b3c447fcf74ef7e49756fa35b13dbf03a3fd16 127.0.0.1:26437@36437,redis-1 slave,fail 59e29b0b4fc1c6f5f2c2698ffdda28cd00f77510 1637115881821 0 0 disconnected",
+			[]ClusterNode{
+				{
+					ID:        "a9b3c447fcf74ef7e49756fa35b13dbf03a3fd16",
+					Addr:      "127.0.0.1:26437",
+					Flags:     []string{"slave", "fail"},
+					PrimaryID: "59e29b0b4fc1c6f5f2c2698ffdda28cd00f77510",
+					LinkState: "disconnected",
+				},
+			},
+			false,
+		},
+		{
+			"a9b3c447fcf74ef7e49756fa35b13dbf03a3fd16 127.0.0.1:26437@36437 slave",
+			nil,
+			true,
+		},
+		{
+			"e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 127.0.0.1:30001@31001 myself,master - 0 0 1 connected 0-five",
+			nil,
+			true,
+		},
+		{
+			"e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 127.0.0.1:30001@31001 myself,master - 0 0 1 connected 0-5460 [5461]",
+			nil,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			got, err := parseClusterNodes(tt.result)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseClusterNodes() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseClusterNodes() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrimaryToRemove(t *testing.T) {
+	nodes, err := parseClusterNodes(clusterNodesFixture)
+	if err != nil {
+		t.Fatalf("failed to parse fixture: %s", err)
+	}
+
+	got, err := PrimaryToRemove(nodes)
+	if err != nil {
+		t.Fatalf("PrimaryToRemove() error = %v", err)
+	}
+	if got.ID != "d289c575dcbc4bdd2931585fd4339089e461a27d" {
+		t.Errorf("PrimaryToRemove() = %s, want the drained primary", got.ID)
+	}
+
+	_, err = PrimaryToRemove(ReplicasOf(nodes, "67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1"))
+	if err == nil {
+		t.Error("PrimaryToRemove() expected an error when no primaries are present")
+	}
+}
+
+func TestPrimaryForReplica(t *testing.T) {
+	tests := []struct {
+		name      string
+		result    string
+		excludeID string
+		want      string
+		wantErr   bool
+	}{
+		{
+			"orphaned primary is preferred",
+			clusterNodesFixture,
+			"d289c575dcbc4bdd2931585fd4339089e461a27d",
+			// 292f8b36 has no replicas.
+			"292f8b365bb7edb5e285caf0b7e6ddc7265d2f4f",
+			false,
+		},
+		{
+			"primary with the fewest replicas",
+			clusterNodesFixture,
+			"292f8b365bb7edb5e285caf0b7e6ddc7265d2f4f",
+			// e7d1eecc and 67ed2db8 have 1 and 2 replicas. The drained primary,
+			// d289c575, serves no shard slots and isn't considered.
+			"e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca",
+			false,
+		},
+		{
+			// Replicas are counted against the primary they replicate, never
+			// against themselves, and are never selected.
+			"replicas are grouped by primary",
+			`07c37dfeb235213a872192d90877d0cd55635b91 127.0.0.1:30004@31004 slave e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 0 1426238317239 4 connected
+6ec23923021cf3ffec47632106199cb7f496ce01 127.0.0.1:30005@31005 slave e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 0 1426238316232 5 connected
+67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1 127.0.0.1:30002@31002 master - 0 1426238316232 2 connected 5461-10922
+824fe116063bc5fcf9f4ffd895bc17aee7731ac3 127.0.0.1:30006@31006 slave 67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1 0 1426238317741 6 connected
+e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 127.0.0.1:30001@31001 myself,master - 0 0 1 connected 0-5460
+292f8b365bb7edb5e285caf0b7e6ddc7265d2f4f 127.0.0.1:30003@31003 master - 0 1426238318243 3 connected 10923-16383
+a9b3c447fcf74ef7e49756fa35b13dbf03a3fd16 127.0.0.1:30008@31008 slave 292f8b365bb7edb5e285caf0b7e6ddc7265d2f4f 0 1426238318243 8 connected
+`,
+			"",
+			// 292f8b36 and 67ed2db8 both have 1 replica, 292f8b36 has the
+			// lowest ID.
+			"292f8b365bb7edb5e285caf0b7e6ddc7265d2f4f",
+			false,
+		},
+		{
+			// A replica that has failed doesn't count, leaving its primary
+			// orphaned.
+			"failed replica is not counted",
+			`07c37dfeb235213a872192d90877d0cd55635b91 127.0.0.1:30004@31004 slave e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 0 1426238317239 4 connected
+67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1 127.0.0.1:30002@31002 master - 0 1426238316232 2 connected 5461-10922
+824fe116063bc5fcf9f4ffd895bc17aee7731ac3 127.0.0.1:30006@31006 slave,fail 67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1 1426238310000 1426238307741 6 disconnected
+e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 127.0.0.1:30001@31001 myself,master - 0 0 1 connected 0-10922
+`,
+			"",
+			"67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1",
+			false,
+		},
+		{
+			// Primaries that are failing or disconnected are never selected,
+			// even when they're orphaned.
+			"failing and disconnected primaries are skipped",
+			`07c37dfeb235213a872192d90877d0cd55635b91 127.0.0.1:30004@31004 slave e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 0 1426238317239 4 connected
+67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1 127.0.0.1:30002@31002 master,fail? - 1426238310000 1426238316232 2 connected 5461-10922
+292f8b365bb7edb5e285caf0b7e6ddc7265d2f4f 127.0.0.1:30003@31003 master - 0 1426238318243 3 disconnected 10923-16383
+e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 127.0.0.1:30001@31001 myself,master - 0 0 1 connected 0-5460
+`,
+			"",
+			"e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca",
+			false,
+		},
+		{
+			"no primary can be selected",
+			`07c37dfeb235213a872192d90877d0cd55635b91 127.0.0.1:30004@31004 myself,slave e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 0 1426238317239 4 connected
+e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 127.0.0.1:30001@31001 master,fail - 1426238310000 1426238300000 1 disconnected 0-16383
+`,
+			"",
+			"",
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes, err := parseClusterNodes(tt.result)
+			if err != nil {
+				t.Fatalf("failed to parse fixture: %s", err)
+			}
+
+			got, err := PrimaryForReplica(nodes, tt.excludeID)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PrimaryForReplica() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got.ID != tt.want {
+				t.Errorf("PrimaryForReplica() = %s, want %s", got.ID, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplicaToRemove(t *testing.T) {
+	nodes, err := parseClusterNodes(clusterNodesFixture)
+	if err != nil {
+		t.Fatalf("failed to parse fixture: %s", err)
+	}
+
+	tests := []struct {
+		nodes []ClusterNode
+		want  string
+	}{
+		// 67ed2db8 has the most replicas, 6ec23923 has the lowest ID of them.
+		{nodes, "6ec23923021cf3ffec47632106199cb7f496ce01"},
+		// A failed replica is always removed first.
+		{
+			append(
+				nodes,
+				ClusterNode{
+					ID:        "a9b3c447fcf74ef7e49756fa35b13dbf03a3fd16",
+					Addr:      "127.0.0.1:30008",
+					Flags:     []string{"slave", "fail"},
+					PrimaryID: "292f8b365bb7edb5e285caf0b7e6ddc7265d2f4f",
+					LinkState: "disconnected",
+				},
+			),
+			"a9b3c447fcf74ef7e49756fa35b13dbf03a3fd16",
+		},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			got, err := ReplicaToRemove(tt.nodes)
+			if err != nil {
+				t.Fatalf("ReplicaToRemove() error = %v", err)
+			}
+			if got.ID != tt.want {
+				t.Errorf("ReplicaToRemove() = %s, want %s", got.ID, tt.want)
+			}
+		})
+	}
+
+	_, err = ReplicaToRemove(nil)
+	if err == nil {
+		t.Error("ReplicaToRemove() expected an error when no replicas are present")
+	}
+}
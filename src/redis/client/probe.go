@@ -0,0 +1,109 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// slotCount is the number of shard slots in a Redis Cluster.
+const slotCount = 16384
+
+// crc16 returns the CRC16 (XMODEM) checksum of `key`, as used by Redis Cluster
+// to map keys to shard slots.
+func crc16(key string) uint16 {
+	var crc uint16
+	for i := 0; i < len(key); i++ {
+		crc ^= uint16(key[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// KeySlot returns the shard slot that `key` maps to, as specified in:
+// https://redis.io/docs/reference/cluster-spec/#hash-tags.
+func KeySlot(key string) int {
+	start := strings.IndexByte(key, '{')
+	if start >= 0 {
+		end := strings.IndexByte(key[start+1:], '}')
+		if end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) % slotCount)
+}
+
+// KeyInSlots returns a key, made up of `prefix` followed by a hash tag, that
+// maps to a shard slot in one of `ranges`, and that shard slot. It returns
+// false if `ranges` contains no shard slots.
+func KeyInSlots(prefix string, ranges []SlotRange) (string, int, bool) {
+	owned := make([]bool, slotCount)
+	var count int
+	for _, r := range ranges {
+		for slot := r.Start; slot <= r.End && slot < slotCount; slot++ {
+			owned[slot] = true
+			count++
+		}
+	}
+	if count == 0 {
+		return "", 0, false
+	}
+
+	// Every shard slot maps from a tag in the first few hundred thousand
+	// integers, so this always terminates.
+	for i := 0; ; i++ {
+		key := prefix + "{" + strconv.Itoa(i) + "}"
+		slot := KeySlot(key)
+		if owned[slot] {
+			return key, slot, true
+		}
+	}
+}
+
+// ProbeWrite sets `key` to a unique value that expires after `ttl`, reads it
+// back and returns an error if either command fails or the value read isn't the
+// value written.
+func (h *Client) ProbeWrite(ctx context.Context, key string, ttl time.Duration) error {
+	value := strconv.FormatInt(time.Now().UnixNano(), 10)
+	err := h.Client.Set(ctx, key, value, ttl).Err()
+	if err != nil {
+		return fmt.Errorf("writing probe key %q: %w", key, err)
+	}
+	got, err := h.Client.Get(ctx, key).Result()
+	if err != nil {
+		return fmt.Errorf("reading probe key %q: %w", key, err)
+	}
+	if got != value {
+		return fmt.Errorf("read %q from probe key %q, expected %q", got, key, value)
+	}
+	return nil
+}
+
+// ProbeRead reads `key` on a connection in 'READONLY' mode, so that this node
+// serves the read even if it's a replica. It returns an error if either command
+// fails. A missing key is not an error.
+func (h *Client) ProbeRead(ctx context.Context, key string) error {
+	conn := h.Client.Conn(ctx)
+	defer conn.Close()
+
+	err := conn.ReadOnly(ctx).Err()
+	if err != nil {
+		return fmt.Errorf("enabling reads from replica: %w", err)
+	}
+	err = conn.Get(ctx, key).Err()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return fmt.Errorf("reading probe key %q: %w", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package client
+
+import "testing"
+
+func TestKeySlot(t *testing.T) {
+	tests := []struct {
+		key  string
+		want int
+	}{
+		{"123456789", 0x31c3 % slotCount},
+		{"foo", 12182},
+		{"bar", 5061},
+		{"{user1000}.following", KeySlot("user1000")},
+		{"{user1000}.followers", KeySlot("user1000")},
+		{"foo{}{bar}", int(crc16("foo{}{bar}") % slotCount)},
+		{"foo{{bar}}zap", KeySlot("{bar")},
+		{"foo{bar}{zap}", KeySlot("bar")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			got := KeySlot(tt.key)
+			if got != tt.want {
+				t.Errorf("KeySlot(%q) = %d, want %d", tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyInSlots(t *testing.T) {
+	tests := []struct {
+		name   string
+		ranges []SlotRange
+		wantOk bool
+	}{
+		{"every slot", []SlotRange{{Start: 0, End: 16383}}, true},
+		{"single slot", []SlotRange{{Start: 9000, End: 9000}}, true},
+		{"several ranges", []SlotRange{{Start: 0, End: 10}, {Start: 16000, End: 16383}}, true},
+		{"no slots", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, slot, ok := KeyInSlots("attache-probe", tt.ranges)
+			if ok != tt.wantOk {
+				t.Fatalf("KeyInSlots() ok = %t, want %t", ok, tt.wantOk)
+			}
+			if !ok {
+				return
+			}
+			if KeySlot(key) != slot {
+				t.Errorf("KeyInSlots() key %q maps to slot %d, not %d", key, KeySlot(key), slot)
+			}
+			var inRange bool
+			for _, r := range tt.ranges {
+				if slot >= r.Start && slot <= r.End {
+					inRange = true
+				}
+			}
+			if !inRange {
+				t.Errorf("KeyInSlots() slot %d is not in %v", slot, tt.ranges)
+			}
+		})
+	}
+}
@@ -0,0 +1,499 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/letsencrypt/attache/src/redis/client"
+	"github.com/letsencrypt/attache/src/redis/config"
+	logger "github.com/sirupsen/logrus"
+)
+
+const (
+	// convergeInterval is the duration to wait between checks that the nodes
+	// of a cluster agree on a configuration change.
+	convergeInterval = time.Second
+
+	// forgetBanWindow is the duration that a node which has been sent 'CLUSTER
+	// FORGET' will refuse to re-add the forgotten node via gossip. Every
+	// remaining node must forget a removed node within this window or the
+	// removed node will be re-introduced by the nodes that haven't forgotten
+	// it yet.
+	forgetBanWindow = 60 * time.Second
+)
+
+// nodeClients creates and caches a client for each Redis node that a cluster
+// operation interacts with.
+type nodeClients struct {
+	// ctx bounds every mutation performed by the operation. Once it's
+	// cancelled no further changes are made to the cluster.
+	ctx     context.Context
+	conf    config.RedisOpts
+	opts    Options
+	clients map[string]*client.Client
+}
+
+func newNodeClients(ctx context.Context, conf config.RedisOpts, opts Options) *nodeClients {
+	return &nodeClients{ctx, conf, opts.withDefaults(), make(map[string]*client.Client)}
+}
+
+// get returns a client for the Redis node at `nodeAddr` using the credentials
+// and TLS configuration in `c.conf`.
+func (c *nodeClients) get(nodeAddr string) (*client.Client, error) {
+	nodeClient, ok := c.clients[nodeAddr]
+	if ok {
+		return nodeClient, nil
+	}
+
+	nodeClient, err := client.New(
+		config.RedisOpts{
+			NodeAddr:       nodeAddr,
+			Username:       c.conf.Username,
+			PasswordConfig: c.conf.PasswordConfig,
+			TLSConfig:      c.conf.TLSConfig,
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	c.clients[nodeAddr] = nodeClient
+	return nodeClient, nil
+}
+
+// close closes every cached client.
+func (c *nodeClients) close() {
+	for addr, nodeClient := range c.clients {
+		_ = nodeClient.Client.Close()
+		delete(c.clients, addr)
+	}
+}
+
+// waitUntil calls `converged` every convergeInterval until it returns true or
+// `c.opts.ConvergeTimeout` has elapsed, in which case ErrNotConverged is
+// returned. Errors returned by `converged` are treated as not having converged
+// yet. If `c.ctx` is cancelled while waiting its error is returned.
+func (c *nodeClients) waitUntil(description string, converged func() (bool, error)) error {
+	deadline := time.Now().Add(c.opts.ConvergeTimeout)
+	for {
+		ok, err := converged()
+		if ok {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return fmt.Errorf("waiting for %s: %w: %s", description, ErrNotConverged, err)
+			}
+			return fmt.Errorf("waiting for %s: %w", description, ErrNotConverged)
+		}
+		select {
+		case <-c.ctx.Done():
+			return fmt.Errorf("waiting for %s: %w", description, c.ctx.Err())
+		case <-time.After(convergeInterval):
+		}
+	}
+}
+
+// knowsNodes returns true if the node at `nodeAddr` has completed a handshake
+// with every node in `nodeIDs`.
+func knowsNodes(clients *nodeClients, nodeAddr string, nodeIDs []string) (bool, error) {
+	nodeClient, err := clients.get(nodeAddr)
+	if err != nil {
+		return false, err
+	}
+
+	nodes, err := nodeClient.GetClusterNodes(clients.ctx)
+	if err != nil {
+		return false, opError("cluster nodes", nodeAddr, err)
+	}
+
+	known := make(map[string]bool)
+	for _, n := range nodes {
+		if !n.InHandshake() {
+			known[n.ID] = true
+		}
+	}
+	for _, id := range nodeIDs {
+		if !known[id] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// meet introduces the node at `nodeAddr` to the cluster that `destNodeAddr`
+// belongs to, then waits for every node in that cluster to learn about it.
+// The ID of the introduced node and the nodes of the cluster, as seen from
+// `destNodeAddr`, are returned.
+func meet(clients *nodeClients, nodeAddr string, destNodeAddr string) (string, []client.ClusterNode, error) {
+	newNode, err := clients.get(nodeAddr)
+	if err != nil {
+		return "", nil, err
+	}
+
+	newNodeID, err := newNode.GetNodeID(clients.ctx)
+	if err != nil {
+		return "", nil, opError("cluster myid", nodeAddr, err)
+	}
+
+	destNode, err := clients.get(destNodeAddr)
+	if err != nil {
+		return "", nil, err
+	}
+
+	nodes, err := destNode.GetClusterNodes(clients.ctx)
+	if err != nil {
+		return "", nil, opError("cluster nodes", destNodeAddr, err)
+	}
+
+	err = newNode.Meet(clients.ctx, destNodeAddr)
+	if err != nil {
+		return "", nil, opError("cluster meet", nodeAddr, err)
+	}
+
+	log := logger.WithFields(logger.Fields{"node": nodeAddr, "dest": destNodeAddr})
+	log.Info("cluster MEET succeeded, waiting for gossip to propagate")
+
+	var nodeIDs []string
+	for _, n := range nodes {
+		if !n.IsFailing() {
+			nodeIDs = append(nodeIDs, n.ID)
+		}
+	}
+
+	err = clients.waitUntil("nodes to learn about "+nodeAddr, func() (bool, error) {
+		ok, err := knowsNodes(clients, nodeAddr, nodeIDs)
+		if !ok {
+			return false, err
+		}
+		for _, n := range nodes {
+			if n.IsFailing() {
+				continue
+			}
+			ok, err := knowsNodes(clients, n.Addr, []string{newNodeID})
+			if !ok {
+				return false, err
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	log.Info("every node has learned about the new node")
+	return newNodeID, nodes, nil
+}
+
+// CreateCluster creates a new Redis Cluster from `nodes`. The first
+// len(nodes)/(replicasPerShard+1) nodes become shard primaries, each assigned
+// an equal share of the shard slots, and the remaining nodes are evenly
+// distributed among them as replicas.
+func CreateCluster(ctx context.Context, conf config.RedisOpts, opts Options, nodes []string, replicasPerShard int) error {
+	clients := newNodeClients(ctx, conf, opts)
+	defer clients.close()
+
+	primaryCount := len(nodes) / (replicasPerShard + 1)
+	if primaryCount < 3 {
+		return fmt.Errorf("cannot create a cluster from %d nodes with %d replicas per shard: %w", len(nodes), replicasPerShard, ErrTooFewPrimaries)
+	}
+
+	nodeIDs := make([]string, len(nodes))
+	for i, nodeAddr := range nodes {
+		nodeClient, err := clients.get(nodeAddr)
+		if err != nil {
+			return err
+		}
+
+		nodeIDs[i], err = nodeClient.GetNodeID(clients.ctx)
+		if err != nil {
+			return opError("cluster myid", nodeAddr, err)
+		}
+
+		// Each node is given a distinct config epoch so that the nodes don't
+		// need to resolve epoch collisions once they meet.
+		err = nodeClient.SetConfigEpoch(clients.ctx, int64(i+1))
+		if err != nil {
+			return opError("cluster set-config-epoch", nodeAddr, err)
+		}
+	}
+
+	for i, slots := range splitSlots(primaryCount) {
+		nodeClient, err := clients.get(nodes[i])
+		if err != nil {
+			return err
+		}
+
+		err = nodeClient.AddSlots(clients.ctx, slots)
+		if err != nil {
+			return opError("cluster addslots", nodes[i], err)
+		}
+		logger.WithFields(logger.Fields{"node": nodes[i], "start": slots.Start, "end": slots.End}).Info("assigned shard slots")
+	}
+
+	firstNode, err := clients.get(nodes[0])
+	if err != nil {
+		return err
+	}
+	for _, nodeAddr := range nodes[1:] {
+		err := firstNode.Meet(clients.ctx, nodeAddr)
+		if err != nil {
+			return opError("cluster meet", nodes[0], err)
+		}
+	}
+
+	err = clients.waitUntil("nodes to join the cluster", func() (bool, error) {
+		for _, nodeAddr := range nodes {
+			ok, err := knowsNodes(clients, nodeAddr, nodeIDs)
+			if !ok {
+				return false, err
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	logger.Info("every node has joined the cluster")
+
+	for i, nodeAddr := range nodes[primaryCount:] {
+		primaryIndex := i % primaryCount
+
+		nodeClient, err := clients.get(nodeAddr)
+		if err != nil {
+			return err
+		}
+
+		err = nodeClient.Replicate(clients.ctx, nodeIDs[primaryIndex])
+		if err != nil {
+			return opError("cluster replicate", nodeAddr, err)
+		}
+		logger.WithFields(logger.Fields{"node": nodeAddr, "primary": nodes[primaryIndex]}).Info("attached replica")
+	}
+
+	return clients.waitUntil("cluster state to be ok", func() (bool, error) {
+		for _, nodeAddr := range nodes {
+			nodeClient, err := clients.get(nodeAddr)
+			if err != nil {
+				return false, err
+			}
+
+			info, err := nodeClient.GetClusterInfo(clients.ctx)
+			if err != nil {
+				return false, opError("cluster info", nodeAddr, err)
+			}
+			if info.State != "ok" {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+}
+
+// Meet introduces the node at `nodeAddr` to the Redis Cluster that
+// `destNodeAddr` belongs to and waits for every node in the cluster to learn
+// about it.
+func Meet(ctx context.Context, conf config.RedisOpts, opts Options, nodeAddr string, destNodeAddr string) error {
+	clients := newNodeClients(ctx, conf, opts)
+	defer clients.close()
+
+	_, _, err := meet(clients, nodeAddr, destNodeAddr)
+	return err
+}
+
+// Rebalance moves shard slots between the primaries of the Redis Cluster that
+// `destNodeAddr` belongs to such that each serves a share of the shard slots
+// proportional to its weight. Primaries absent from `weights` have a weight of
+// 1. A primary with a weight of 0 is drained of all of its slots.
+func Rebalance(ctx context.Context, conf config.RedisOpts, opts Options, destNodeAddr string, weights map[string]int) error {
+	clients := newNodeClients(ctx, conf, opts)
+	defer clients.close()
+
+	return rebalance(clients, destNodeAddr, weights)
+}
+
+// Replicate reconfigures the node at `nodeAddr` as a replica of the shard
+// primary with ID `primaryID`.
+func Replicate(ctx context.Context, conf config.RedisOpts, opts Options, nodeAddr string, primaryID string) error {
+	clients := newNodeClients(ctx, conf, opts)
+	defer clients.close()
+
+	nodeClient, err := clients.get(nodeAddr)
+	if err != nil {
+		return err
+	}
+
+	err = nodeClient.Replicate(clients.ctx, primaryID)
+	if err != nil {
+		return opError("cluster replicate", nodeAddr, err)
+	}
+	logger.WithFields(logger.Fields{"node": nodeAddr, "primary": primaryID}).Info("attached replica")
+	return nil
+}
+
+// AdoptSlots assigns every shard slot of the failed shard primary with ID
+// `failedID` to the node at `nodeAddr`, which must already be a member of the
+// cluster that `destNodeAddr` belongs to. This is only used when a failed
+// primary has no replica that could take over its slots, so the keys in those
+// slots are lost.
+func AdoptSlots(ctx context.Context, conf config.RedisOpts, opts Options, nodeAddr string, destNodeAddr string, failedID string) error {
+	clients := newNodeClients(ctx, conf, opts)
+	defer clients.close()
+
+	destNode, err := clients.get(destNodeAddr)
+	if err != nil {
+		return err
+	}
+
+	nodes, err := destNode.GetClusterNodes(clients.ctx)
+	if err != nil {
+		return opError("cluster nodes", destNodeAddr, err)
+	}
+
+	var failed *client.ClusterNode
+	for i, n := range nodes {
+		if n.ID == failedID {
+			failed = &nodes[i]
+		}
+	}
+	if failed == nil {
+		return fmt.Errorf("node %s is not known to %s", failedID, destNodeAddr)
+	}
+	if !failed.HasFailed() {
+		return fmt.Errorf("cannot adopt the shard slots of %s, it hasn't failed", failed.Addr)
+	}
+
+	newNode, err := clients.get(nodeAddr)
+	if err != nil {
+		return err
+	}
+
+	newNodeID, err := newNode.GetNodeID(clients.ctx)
+	if err != nil {
+		return opError("cluster myid", nodeAddr, err)
+	}
+
+	// The slots are unassigned, then claimed, in the new node's view of the
+	// cluster. Bumping its config epoch ensures that every other node accepts
+	// the new claim over that of the failed primary.
+	for _, slots := range failed.Slots {
+		err = newNode.DelSlots(clients.ctx, slots)
+		if err != nil {
+			return opError("cluster delslots", nodeAddr, err)
+		}
+		err = newNode.AddSlots(clients.ctx, slots)
+		if err != nil {
+			return opError("cluster addslots", nodeAddr, err)
+		}
+		logger.WithFields(logger.Fields{"node": nodeAddr, "start": slots.Start, "end": slots.End}).Info("adopted shard slots")
+	}
+
+	err = newNode.BumpEpoch(clients.ctx)
+	if err != nil {
+		return opError("cluster bumpepoch", nodeAddr, err)
+	}
+
+	return clients.waitUntil("nodes to learn the new owner of adopted shard slots", func() (bool, error) {
+		nodes, err := destNode.GetClusterNodes(clients.ctx)
+		if err != nil {
+			return false, opError("cluster nodes", destNodeAddr, err)
+		}
+		for _, n := range nodes {
+			if n.ID == newNodeID {
+				return n.SlotCount() >= failed.SlotCount(), nil
+			}
+		}
+		return false, nil
+	})
+}
+
+// removeNode resets `node`, if it's reachable, then sends 'CLUSTER FORGET' for
+// it to every other node in `nodes`. Nodes that can't be reached are skipped,
+// since they can't gossip about the removed node.
+func removeNode(clients *nodeClients, nodes []client.ClusterNode, node client.ClusterNode) error {
+	log := logger.WithFields(logger.Fields{"node": node.Addr, "id": node.ID})
+	if node.IsConnected() && !node.IsFailing() {
+		nodeClient, err := clients.get(node.Addr)
+		if err != nil {
+			return err
+		}
+		err = nodeClient.Reset(clients.ctx)
+		if err != nil {
+			return opError("cluster reset", node.Addr, err)
+		}
+		log.Info("node was reset")
+	}
+
+	start := time.Now()
+	for _, n := range nodes {
+		if n.ID == node.ID || n.IsFailing() {
+			continue
+		}
+		if time.Since(start) >= forgetBanWindow {
+			return fmt.Errorf("couldn't forget %s on every node within %s: %w", node.ID, forgetBanWindow, ErrNotConverged)
+		}
+
+		nodeClient, err := clients.get(n.Addr)
+		if err != nil {
+			return err
+		}
+		err = nodeClient.Forget(clients.ctx, node.ID)
+		if err != nil {
+			return opError("cluster forget", n.Addr, err)
+		}
+	}
+	log.Info("node was forgotten by every node in the cluster")
+	return nil
+}
+
+// RemoveNode removes the node with ID `nodeID` from the Redis Cluster that
+// `destNodeAddr` belongs to. The node is reset, if it's reachable, then
+// forgotten by every remaining node. Shard primaries must be drained of their
+// shard slots, and have their replicas moved, before they can be removed.
+// If the node still has replicas, which may have only just been moved, it
+// waits up to the converge timeout for them to be seen to move.
+func RemoveNode(ctx context.Context, conf config.RedisOpts, opts Options, destNodeAddr string, nodeID string) error {
+	clients := newNodeClients(ctx, conf, opts)
+	defer clients.close()
+
+	destNode, err := clients.get(destNodeAddr)
+	if err != nil {
+		return err
+	}
+
+	// Replicas that were just moved off of the node with CLUSTER REPLICATE may
+	// not have been seen to move by the destination node yet, so it's given
+	// until the converge timeout to see them go.
+	var nodes []client.ClusterNode
+	var target *client.ClusterNode
+	err = clients.waitUntil("replicas of "+nodeID+" to move to other shard primaries", func() (bool, error) {
+		var err error
+		nodes, err = destNode.GetClusterNodes(clients.ctx)
+		if err != nil {
+			return false, opError("cluster nodes", destNodeAddr, err)
+		}
+		target = nil
+		for i, n := range nodes {
+			if n.ID == nodeID {
+				target = &nodes[i]
+			}
+		}
+		if target == nil || target.SlotCount() > 0 {
+			return true, nil
+		}
+		replicas := client.ReplicasOf(nodes, nodeID)
+		if len(replicas) > 0 {
+			return false, fmt.Errorf("cannot remove %s while it has %d replicas", target.Addr, len(replicas))
+		}
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	if target == nil {
+		return fmt.Errorf("node %s is not known to %s", nodeID, destNodeAddr)
+	}
+	if target.SlotCount() > 0 {
+		return fmt.Errorf("cannot remove %s while it serves %d shard slots", target.Addr, target.SlotCount())
+	}
+	return removeNode(clients, nodes, *target)
+}
@@ -0,0 +1,46 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrNotConverged is returned when the nodes of a cluster fail to agree on
+	// the cluster configuration before a deadline.
+	ErrNotConverged = errors.New("cluster configuration did not converge")
+
+	// ErrTooFewPrimaries is returned when an operation would leave a cluster
+	// with less than the minimum of 3 shard primaries that Redis Cluster
+	// requires.
+	ErrTooFewPrimaries = errors.New("a redis cluster requires at least 3 shard primaries")
+)
+
+// OpError is returned when a Redis command issued as part of a cluster
+// operation fails.
+type OpError struct {
+	// Op is the name of the cluster operation (e.g. 'meet', 'migrate').
+	Op string
+
+	// Node is the address of the node that the failed command was sent to.
+	Node string
+
+	// Err is the error returned by the node.
+	Err error
+}
+
+func (e *OpError) Error() string {
+	return fmt.Sprintf("%s on %s failed: %s", e.Op, e.Node, e.Err)
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// opError returns an *OpError for `op` on `node` if `err` is not nil.
+func opError(op string, node string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &OpError{op, node, err}
+}
@@ -0,0 +1,52 @@
+package cluster
+
+import "time"
+
+const (
+	// defaultConvergeTimeout is the default maximum duration to wait for the
+	// nodes of a cluster to agree on a configuration change.
+	defaultConvergeTimeout = 60 * time.Second
+
+	// defaultMigrateBatchSize is the default maximum number of keys moved by a
+	// single 'MIGRATE' command.
+	defaultMigrateBatchSize = 10
+
+	// defaultMigrateTimeout is the default maximum idle time of a single
+	// 'MIGRATE' command.
+	defaultMigrateTimeout = 60 * time.Second
+)
+
+// Options tunes how cluster operations are performed. Fields left at their
+// zero value use the defaults above.
+type Options struct {
+	// RebalanceThreshold is the percentage by which the count of shard slots
+	// served by at least one primary must differ from its expected share
+	// before a rebalance moves any slots. When 0, slots are always moved.
+	RebalanceThreshold int
+
+	// MigrateBatchSize is the maximum number of keys moved by a single
+	// 'MIGRATE' command.
+	MigrateBatchSize int
+
+	// MigrateTimeout is the maximum idle time of a single 'MIGRATE' command.
+	MigrateTimeout time.Duration
+
+	// ConvergeTimeout is the maximum duration to wait for the nodes of a
+	// cluster to agree on a configuration change.
+	ConvergeTimeout time.Duration
+}
+
+// withDefaults returns a copy of `o` with the default of each field that was
+// left at its zero value filled in.
+func (o Options) withDefaults() Options {
+	if o.MigrateBatchSize == 0 {
+		o.MigrateBatchSize = defaultMigrateBatchSize
+	}
+	if o.MigrateTimeout == 0 {
+		o.MigrateTimeout = defaultMigrateTimeout
+	}
+	if o.ConvergeTimeout == 0 {
+		o.ConvergeTimeout = defaultConvergeTimeout
+	}
+	return o
+}
@@ -0,0 +1,442 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/letsencrypt/attache/src/redis/client"
+	"github.com/letsencrypt/attache/src/redis/config"
+	logger "github.com/sirupsen/logrus"
+)
+
+const (
+	// totalSlots is the number of shard slots in every Redis Cluster.
+	totalSlots = 16384
+)
+
+// slotMove is a single shard slot that should be moved from one shard primary
+// to another.
+type slotMove struct {
+	Slot   int
+	Source client.ClusterNode
+	Target client.ClusterNode
+}
+
+// splitSlots divides every shard slot into `count` contiguous ranges of as
+// close to equal size as possible.
+func splitSlots(count int) []client.SlotRange {
+	ranges := make([]client.SlotRange, 0, count)
+	start := 0
+	for i := 0; i < count; i++ {
+		size := totalSlots / count
+		if i < totalSlots%count {
+			size++
+		}
+		ranges = append(ranges, client.SlotRange{Start: start, End: start + size - 1})
+		start += size
+	}
+	return ranges
+}
+
+// expandSlots returns every shard slot served by `node` in ascending order.
+func expandSlots(node client.ClusterNode) []int {
+	var slots []int
+	for _, r := range node.Slots {
+		for slot := r.Start; slot <= r.End; slot++ {
+			slots = append(slots, slot)
+		}
+	}
+	sort.Ints(slots)
+	return slots
+}
+
+// planSlotMoves returns the shard slot moves required for every healthy shard
+// primary in `nodes` to serve a share of the shard slots proportional to its
+// weight. Primaries absent from `weights` have a weight of 1. A primary with a
+// weight of 0 will be drained of all of its slots. If `threshold` is greater
+// than 0 and every primary serves within `threshold` percent of its share, no
+// moves are returned.
+func planSlotMoves(nodes []client.ClusterNode, weights map[string]int, threshold int) ([]slotMove, error) {
+	var primaries []client.ClusterNode
+	var totalWeight int
+	for _, n := range nodes {
+		if !n.IsPrimary() || n.IsFailing() {
+			continue
+		}
+		weight, ok := weights[n.ID]
+		if !ok {
+			weight = 1
+		}
+		totalWeight += weight
+		primaries = append(primaries, n)
+	}
+	if totalWeight == 0 {
+		return nil, errors.New("at least one shard primary must have a weight greater than 0")
+	}
+	sort.Slice(primaries, func(i, j int) bool { return primaries[i].ID < primaries[j].ID })
+
+	weightOf := func(n client.ClusterNode) int {
+		weight, ok := weights[n.ID]
+		if !ok {
+			return 1
+		}
+		return weight
+	}
+
+	// Calculate the number of slots each primary should serve. Any slots left
+	// over due to rounding are given to the weighted primaries in order.
+	expected := make(map[string]int)
+	var assigned int
+	for _, n := range primaries {
+		expected[n.ID] = totalSlots * weightOf(n) / totalWeight
+		assigned += expected[n.ID]
+	}
+	for i := 0; assigned < totalSlots; i = (i + 1) % len(primaries) {
+		if weightOf(primaries[i]) > 0 {
+			expected[primaries[i].ID]++
+			assigned++
+		}
+	}
+
+	// Nothing is moved unless at least one primary is outside of the threshold
+	// percentage of its expected share of slots.
+	if threshold > 0 {
+		var unbalanced bool
+		for _, n := range primaries {
+			diff := n.SlotCount() - expected[n.ID]
+			if diff < 0 {
+				diff = -diff
+			}
+			if diff*100 > threshold*expected[n.ID] {
+				unbalanced = true
+			}
+		}
+		if !unbalanced {
+			return nil, nil
+		}
+	}
+
+	// Pool the slots that primaries serving more than expected must give up,
+	// taking them from the end of their ranges.
+	var surplus []slotMove
+	for _, n := range primaries {
+		slots := expandSlots(n)
+		for _, slot := range slots[minInt(expected[n.ID], len(slots)):] {
+			surplus = append(surplus, slotMove{Slot: slot, Source: n})
+		}
+	}
+
+	// Hand the pooled slots to primaries serving less than expected.
+	var moves []slotMove
+	for _, n := range primaries {
+		deficit := expected[n.ID] - n.SlotCount()
+		for ; deficit > 0 && len(surplus) > 0; deficit-- {
+			move := surplus[0]
+			surplus = surplus[1:]
+			move.Target = n
+			moves = append(moves, move)
+		}
+	}
+	return moves, nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// migrateSlot moves `move.Slot`, and every key in it, from `move.Source` to
+// `move.Target`, then informs every primary in `primaries` of the new owner.
+func migrateSlot(clients *nodeClients, move slotMove, primaries []client.ClusterNode) error {
+	source, err := clients.get(move.Source.Addr)
+	if err != nil {
+		return err
+	}
+	target, err := clients.get(move.Target.Addr)
+	if err != nil {
+		return err
+	}
+
+	err = target.SetSlot(clients.ctx, move.Slot, "importing", move.Source.ID)
+	if err != nil {
+		return opError("setslot importing", move.Target.Addr, err)
+	}
+
+	err = source.SetSlot(clients.ctx, move.Slot, "migrating", move.Target.ID)
+	if err != nil {
+		return opError("setslot migrating", move.Source.Addr, err)
+	}
+	return finishSlot(clients, move, primaries)
+}
+
+// finishSlot moves every key remaining in `move.Slot` from `move.Source` to
+// `move.Target`, which must already be importing or own the slot, then informs
+// every primary in `primaries` of the new owner.
+func finishSlot(clients *nodeClients, move slotMove, primaries []client.ClusterNode) error {
+	source, err := clients.get(move.Source.Addr)
+	if err != nil {
+		return err
+	}
+	target, err := clients.get(move.Target.Addr)
+	if err != nil {
+		return err
+	}
+
+	for {
+		keys, err := source.GetKeysInSlot(clients.ctx, move.Slot, clients.opts.MigrateBatchSize)
+		if err != nil {
+			return opError("getkeysinslot", move.Source.Addr, err)
+		}
+		if len(keys) == 0 {
+			break
+		}
+
+		err = source.Migrate(clients.ctx, move.Target.Addr, keys, clients.opts.MigrateTimeout)
+		if err != nil {
+			return opError("migrate", move.Source.Addr, err)
+		}
+	}
+
+	// The target must be informed first so that the slot isn't left without
+	// an owner if the source is informed but the target is not.
+	err = target.SetSlot(clients.ctx, move.Slot, "node", move.Target.ID)
+	if err != nil {
+		return opError("setslot node", move.Target.Addr, err)
+	}
+
+	err = source.SetSlot(clients.ctx, move.Slot, "node", move.Target.ID)
+	if err != nil {
+		return opError("setslot node", move.Source.Addr, err)
+	}
+
+	for _, n := range primaries {
+		if n.ID == move.Source.ID || n.ID == move.Target.ID || n.IsFailing() {
+			continue
+		}
+		primary, err := clients.get(n.Addr)
+		if err != nil {
+			return err
+		}
+		err = primary.SetSlot(clients.ctx, move.Slot, "node", move.Target.ID)
+		if err != nil {
+			return opError("setslot node", n.Addr, err)
+		}
+	}
+	return nil
+}
+
+// slotRanges returns the shard slots moved by `moves` as sorted ranges.
+func slotRanges(moves []slotMove) []client.SlotRange {
+	slots := make([]int, 0, len(moves))
+	for _, m := range moves {
+		slots = append(slots, m.Slot)
+	}
+	sort.Ints(slots)
+
+	var ranges []client.SlotRange
+	for _, slot := range slots {
+		last := len(ranges) - 1
+		if last >= 0 && ranges[last].End+1 == slot {
+			ranges[last].End = slot
+			continue
+		}
+		ranges = append(ranges, client.SlotRange{Start: slot, End: slot})
+	}
+	return ranges
+}
+
+// RebalanceSlots returns the shard slots that Rebalance would move, given the
+// same arguments, as sorted ranges. The cluster isn't modified.
+func RebalanceSlots(ctx context.Context, conf config.RedisOpts, opts Options, destNodeAddr string, weights map[string]int) ([]client.SlotRange, error) {
+	clients := newNodeClients(ctx, conf, opts)
+	defer clients.close()
+
+	destNode, err := clients.get(destNodeAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes, err := destNode.GetClusterNodes(clients.ctx)
+	if err != nil {
+		return nil, opError("cluster nodes", destNodeAddr, err)
+	}
+
+	moves, err := planSlotMoves(nodes, weights, clients.opts.RebalanceThreshold)
+	if err != nil {
+		return nil, err
+	}
+	return slotRanges(moves), nil
+}
+
+// openSlotMoves returns a slotMove for every shard slot that a primary in
+// `primaries` reports as migrating or importing in its own view of the cluster,
+// such as those left behind by a rebalance that was interrupted. `nodes` is
+// used to look up the other end of each move.
+func openSlotMoves(clients *nodeClients, nodes []client.ClusterNode, primaries []client.ClusterNode) ([]slotMove, error) {
+	byID := make(map[string]client.ClusterNode)
+	for _, n := range nodes {
+		byID[n.ID] = n
+	}
+
+	moves := make(map[int]slotMove)
+	for _, p := range primaries {
+		if p.IsFailing() {
+			continue
+		}
+		nodeClient, err := clients.get(p.Addr)
+		if err != nil {
+			return nil, err
+		}
+		view, err := nodeClient.GetClusterNodes(clients.ctx)
+		if err != nil {
+			return nil, opError("cluster nodes", p.Addr, err)
+		}
+
+		for _, me := range view {
+			if !me.IsMyself() {
+				continue
+			}
+			for slot, targetID := range me.Migrating {
+				target, ok := byID[targetID]
+				if !ok {
+					return nil, fmt.Errorf("%s is migrating slot %d to unknown node %s", p.Addr, slot, targetID)
+				}
+				moves[slot] = slotMove{Slot: slot, Source: p, Target: target}
+			}
+			for slot, sourceID := range me.Importing {
+				if _, ok := moves[slot]; ok {
+					continue
+				}
+				source, ok := byID[sourceID]
+				if !ok {
+					return nil, fmt.Errorf("%s is importing slot %d from unknown node %s", p.Addr, slot, sourceID)
+				}
+				moves[slot] = slotMove{Slot: slot, Source: source, Target: p}
+			}
+		}
+	}
+
+	var sorted []slotMove
+	for _, m := range moves {
+		sorted = append(sorted, m)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Slot < sorted[j].Slot })
+	return sorted, nil
+}
+
+// FixOpenSlots finishes moving every shard slot that a primary of the Redis
+// Cluster that `destNodeAddr` belongs to reports as migrating or importing. If
+// the target already owns a slot, only the remaining keys are moved and the
+// other primaries informed, otherwise the slot is migrated again from the
+// start. It returns the number of slots that were fixed.
+func FixOpenSlots(ctx context.Context, conf config.RedisOpts, opts Options, destNodeAddr string) (int, error) {
+	clients := newNodeClients(ctx, conf, opts)
+	defer clients.close()
+
+	destNode, err := clients.get(destNodeAddr)
+	if err != nil {
+		return 0, err
+	}
+
+	nodes, err := destNode.GetClusterNodes(clients.ctx)
+	if err != nil {
+		return 0, opError("cluster nodes", destNodeAddr, err)
+	}
+
+	var primaries []client.ClusterNode
+	for _, n := range nodes {
+		if n.IsPrimary() {
+			primaries = append(primaries, n)
+		}
+	}
+
+	moves, err := openSlotMoves(clients, nodes, primaries)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, move := range moves {
+		if move.Source.IsFailing() || move.Target.IsFailing() {
+			return 0, fmt.Errorf("cannot fix slot %d, moving from %s to %s, while either node is failing", move.Slot, move.Source.Addr, move.Target.Addr)
+		}
+
+		target, err := clients.get(move.Target.Addr)
+		if err != nil {
+			return 0, err
+		}
+		view, err := target.GetClusterNodes(clients.ctx)
+		if err != nil {
+			return 0, opError("cluster nodes", move.Target.Addr, err)
+		}
+
+		var targetOwnsSlot bool
+		for _, me := range view {
+			if me.IsMyself() {
+				targetOwnsSlot = me.ServesSlot(move.Slot)
+			}
+		}
+
+		log := logger.WithFields(logger.Fields{"slot": move.Slot, "source": move.Source.Addr, "target": move.Target.Addr})
+		if targetOwnsSlot {
+			err = finishSlot(clients, move, primaries)
+		} else {
+			err = migrateSlot(clients, move, primaries)
+		}
+		if err != nil {
+			return 0, err
+		}
+		log.Info("fixed open shard slot")
+	}
+	return len(moves), nil
+}
+
+// rebalance moves shard slots between the primaries known to the node at
+// `nodeAddr` such that each serves a share of the shard slots proportional to
+// its weight. See planSlotMoves for how `weights` is interpreted.
+func rebalance(clients *nodeClients, nodeAddr string, weights map[string]int) error {
+	nodeClient, err := clients.get(nodeAddr)
+	if err != nil {
+		return err
+	}
+
+	nodes, err := nodeClient.GetClusterNodes(clients.ctx)
+	if err != nil {
+		return opError("cluster nodes", nodeAddr, err)
+	}
+
+	moves, err := planSlotMoves(nodes, weights, clients.opts.RebalanceThreshold)
+	if err != nil {
+		return err
+	}
+	logger.WithField("slots", len(moves)).Info("rebalancing shard slots")
+
+	var primaries []client.ClusterNode
+	for _, n := range nodes {
+		if n.IsPrimary() {
+			primaries = append(primaries, n)
+		}
+	}
+
+	for i, move := range moves {
+		err := migrateSlot(clients, move, primaries)
+		if err != nil {
+			return err
+		}
+
+		log := logger.WithFields(logger.Fields{
+			"slot":   move.Slot,
+			"source": move.Source.Addr,
+			"target": move.Target.Addr,
+		})
+		if (i+1)%100 == 0 || i+1 == len(moves) {
+			log.Infof("migrated %d of %d shard slots", i+1, len(moves))
+		} else {
+			log.Debug("migrated shard slot")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package cluster
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/letsencrypt/attache/src/redis/client"
+)
+
+func Test_splitSlots(t *testing.T) {
+	tests := []struct {
+		count int
+		want  []client.SlotRange
+	}{
+		{1, []client.SlotRange{{Start: 0, End: 16383}}},
+		{3, []client.SlotRange{{Start: 0, End: 5461}, {Start: 5462, End: 10922}, {Start: 10923, End: 16383}}},
+		{4, []client.SlotRange{{Start: 0, End: 4095}, {Start: 4096, End: 8191}, {Start: 8192, End: 12287}, {Start: 12288, End: 16383}}},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			got := splitSlots(tt.count)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitSlots() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func primary(id string, slots ...client.SlotRange) client.ClusterNode {
+	return client.ClusterNode{
+		ID:        id,
+		Addr:      "127.0.0.1:" + id,
+		Flags:     []string{"master"},
+		LinkState: "connected",
+		Slots:     slots,
+	}
+}
+
+// slotCounts returns the number of slots each node would serve after `moves`.
+func slotCounts(nodes []client.ClusterNode, moves []slotMove) map[string]int {
+	counts := make(map[string]int)
+	for _, n := range nodes {
+		counts[n.ID] = n.SlotCount()
+	}
+	for _, m := range moves {
+		counts[m.Source.ID]--
+		counts[m.Target.ID]++
+	}
+	return counts
+}
+
+func Test_planSlotMoves(t *testing.T) {
+	threePrimaries := []client.ClusterNode{
+		primary("1", client.SlotRange{Start: 0, End: 5461}),
+		primary("2", client.SlotRange{Start: 5462, End: 10922}),
+		primary("3", client.SlotRange{Start: 10923, End: 16383}),
+	}
+
+	tests := []struct {
+		name      string
+		nodes     []client.ClusterNode
+		weights   map[string]int
+		threshold int
+		want      map[string]int
+		wantErr   bool
+	}{
+		{
+			"balanced",
+			threePrimaries,
+			nil,
+			0,
+			map[string]int{"1": 5462, "2": 5461, "3": 5461},
+			false,
+		},
+		{
+			"empty primary",
+			append(threePrimaries, primary("4")),
+			nil,
+			0,
+			map[string]int{"1": 4096, "2": 4096, "3": 4096, "4": 4096},
+			false,
+		},
+		{
+			"empty primary outside of the threshold",
+			append(threePrimaries, primary("4")),
+			nil,
+			2,
+			map[string]int{"1": 4096, "2": 4096, "3": 4096, "4": 4096},
+			false,
+		},
+		{
+			"within the threshold",
+			[]client.ClusterNode{
+				primary("1", client.SlotRange{Start: 0, End: 5499}),
+				primary("2", client.SlotRange{Start: 5500, End: 10922}),
+				primary("3", client.SlotRange{Start: 10923, End: 16383}),
+			},
+			nil,
+			2,
+			map[string]int{"1": 5500, "2": 5423, "3": 5461},
+			false,
+		},
+		{
+			"drained primary",
+			[]client.ClusterNode{
+				primary("1", client.SlotRange{Start: 0, End: 5461}),
+				primary("2", client.SlotRange{Start: 5462, End: 10922}),
+				primary("3", client.SlotRange{Start: 10923, End: 16382}),
+				primary("4", client.SlotRange{Start: 16383, End: 16383}),
+			},
+			map[string]int{"2": 0},
+			2,
+			map[string]int{"1": 5462, "2": 0, "3": 5461, "4": 5461},
+			false,
+		},
+		{
+			"all primaries drained",
+			threePrimaries,
+			map[string]int{"1": 0, "2": 0, "3": 0},
+			0,
+			nil,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			moves, err := planSlotMoves(tt.nodes, tt.weights, tt.threshold)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("planSlotMoves() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			got := slotCounts(tt.nodes, moves)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("planSlotMoves() results in %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_slotRanges(t *testing.T) {
+	moves := []slotMove{{Slot: 7}, {Slot: 3}, {Slot: 4}, {Slot: 5}, {Slot: 9}, {Slot: 10}}
+	want := []client.SlotRange{{Start: 3, End: 5}, {Start: 7, End: 7}, {Start: 9, End: 10}}
+
+	got := slotRanges(moves)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("slotRanges() = %v, want %v", got, want)
+	}
+}
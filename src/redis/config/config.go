@@ -24,8 +24,8 @@ type RedisOpts struct {
 	PasswordConfig
 
 	// TLSConfig contains the paths to certificates and a key used by the
-	// redis-go client and redis-cli to interact with Redis nodes using mutual
-	// TLS. This field is required.
+	// redis-go client to interact with Redis nodes using mutual TLS. This
+	// field is required.
 	TLSConfig
 }
 
@@ -45,7 +45,7 @@ func (c PasswordConfig) LoadPassword() (string, error) {
 }
 
 // TLSConfig contains the paths to certificates and a key used by the redis-go
-// client and redis-cli to interact with Redis nodes using mutual TLS.
+// client to interact with Redis nodes using mutual TLS.
 type TLSConfig struct {
 	// CertFile is the path to a PEM formatted Certificate.
 	CertFile string